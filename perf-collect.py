@@ -10,6 +10,9 @@ import os
 import sys
 import subprocess  # nosec
 import shlex  # nosec
+import shutil
+import signal
+import time
 from src import perf_helpers
 from src import prepare_perf_events as prep_events
 
@@ -29,6 +32,8 @@ def write_metadata(
     nogroups,
     percore,
     supervisor,
+    collection_env,
+    markers,
     metadata_only=False,
 ):
     tsc_freq = str(perf_helpers.get_tsc_freq())
@@ -44,7 +49,13 @@ def write_metadata(
     with open(outcsv, "w") as modified:
         modified.write("### META DATA ###,\n")
         modified.write("TSC Frequency(MHz)," + tsc_freq + ",\n")
-        modified.write("CPU count," + str(perf_helpers.get_cpu_count()) + ",\n")
+        cpu_count = perf_helpers.get_cpu_count()
+        if args.cpu:
+            # per socket count that makes the total match the selected CPUs
+            cpu_count = len(perf_helpers.parse_cpu_list(args.cpu)) / (
+                perf_helpers.get_socket_count() * perf_helpers.get_ht_count()
+            )
+        modified.write("CPU count," + str(cpu_count) + ",\n")
         modified.write("SOCKET count," + str(perf_helpers.get_socket_count()) + ",\n")
         if args.pid or args.cgroup:
             modified.write("HT count," + str(1) + ",\n")
@@ -71,6 +82,10 @@ def write_metadata(
         modified.write("User mode," + supervisor + ",\n")
         modified.write("Percore mode," + percoremode + ",\n")
         modified.write("PerfSpect version," + perf_helpers.get_tool_version() + ",\n")
+        for name, value in collection_env:
+            modified.write(name + "," + value + ",\n")
+        for marker in markers:
+            modified.write("Marker,%.3f,\n" % marker)
         modified.write("### PERF EVENTS ###" + ",\n")
         for e in collection_events:
             modified.write(e + "\n")
@@ -78,7 +93,7 @@ def write_metadata(
         modified.write("### PERF DATA ###" + ",\n")
         if time_stamp:
             zone = subprocess.check_output(  # nosec
-                ["date"], universal_newlines=True  # nosec
+                ["date"], universal_newlines=True, env=perf_helpers.get_c_locale_env()
             ).split()  # nosec
             epoch = str(perf_helpers.get_epoch(time_stamp))
             modified.write(
@@ -87,6 +102,115 @@ def write_metadata(
         modified.write(data)
 
 
+# get cgroup limits and cpu affinity of the collector and the monitored pids
+def get_collection_env(pids):
+    cpu_count = os.cpu_count()
+    collection_env = [("cgroup version", str(perf_helpers.get_cgroup_version()))]
+    contexts = [("collector", os.getpid())]
+    if pids:
+        contexts += [("pid " + p.strip(), p.strip()) for p in pids.split(",")]
+    for context, pid in contexts:
+        limits = perf_helpers.get_cgroup_limits(pid)
+        affinity = perf_helpers.get_cpu_affinity_count(pid)
+        for name, value in limits.items():
+            collection_env.append(
+                ("cgroup %s (%s)" % (name, context), value.replace(",", ";"))
+            )
+        collection_env.append(
+            ("cpu affinity (%s)" % context, "%d of %d" % (affinity, cpu_count))
+        )
+        quota = limits["cpu quota"]
+        limited = quota != "unlimited" and float(quota) < cpu_count
+        if limited or affinity < cpu_count:
+            print(
+                "Warning: %s is restricted to %s CPUs (cgroup quota) and %d of %d CPUs (affinity), results may be biased"
+                % (context, quota, affinity, cpu_count)
+            )
+    return collection_env
+
+
+# free disk space in MB below which the preflight check warns
+preflight_free_mb = 100
+
+
+# check if the system is ready for perf collection, returns False on failures
+def preflight_check(outcsv):
+    ready = True
+    perf = shutil.which("perf")
+    if perf:
+        perf_version = subprocess.check_output(  # nosec
+            ["perf", "--version"],
+            universal_newlines=True,
+            env=perf_helpers.get_c_locale_env(),
+        )
+        print("PASS: %s" % perf_version.strip())
+    else:
+        print("FAIL: perf not found; please install linux perf utility")
+        ready = False
+
+    try:
+        arch, _ = perf_helpers.check_architecture(perf_helpers.get_cpuinfo())
+        print("PASS: architecture %s supported" % arch)
+    except SystemExit:
+        print("FAIL: architecture not supported")
+        ready = False
+
+    supervisor = os.geteuid() == 0
+    paranoid = perf_helpers.read_first_line("/proc/sys/kernel/perf_event_paranoid")
+    if supervisor:
+        print("PASS: running with root privileges")
+    else:
+        print("WARN: not root, perf event mux interval and nmi_watchdog can't be set")
+        if paranoid is not None and int(paranoid) > 0:
+            print(
+                "FAIL: perf_event_paranoid is %s, system wide collection needs 0 or lower"
+                % paranoid
+            )
+            ready = False
+
+    nmi_watchdog = perf_helpers.read_first_line("/proc/sys/kernel/nmi_watchdog")
+    if nmi_watchdog is None:
+        print("WARN: nmi_watchdog state can't be read")
+    elif int(nmi_watchdog) != 0 and not supervisor:
+        print("WARN: nmi_watchdog enabled, perf grouping will be disabled")
+    else:
+        print("PASS: nmi_watchdog can be disabled during collection")
+
+    if os.path.exists("/dev/cpu/0/msr"):
+        print("PASS: msr module loaded")
+    else:
+        print("WARN: msr module not loaded, --dryrun can't check PMU usage")
+
+    if perf_helpers.check_file_writeable(outcsv):
+        print("PASS: %s writeable" % outcsv)
+    else:
+        print("FAIL: %s not writeable" % outcsv)
+        ready = False
+
+    # binaries are built with --runtime-tmpdir . and unpack to the working dir,
+    # the output grows for the whole collection
+    if hasattr(sys, "_MEIPASS"):
+        unpack_dir = os.path.dirname(sys._MEIPASS)
+    else:
+        unpack_dir = os.getcwd()
+    outdir = outcsv if os.path.isdir(outcsv) else os.path.dirname(outcsv) or "."
+    for name, path in (("unpack dir", unpack_dir), ("output dir", outdir)):
+        if not os.path.isdir(path):
+            continue
+        free_mb = shutil.disk_usage(path).free // (1024 * 1024)
+        if free_mb < preflight_free_mb:
+            print("WARN: only %d MB free in %s %s" % (free_mb, name, path))
+        else:
+            print("PASS: %d MB free in %s %s" % (free_mb, name, path))
+    return ready
+
+
+# get the output file of a pid when collecting each pid separately
+def get_pid_outfile(outcsv, pid):
+    root, ext = os.path.splitext(outcsv)
+    return "%s.%s%s" % (root, pid.strip(), ext)
+
+
 def resource_path(relative_path):
     """Get absolute path to resource, works for dev and for PyInstaller"""
     base_path = getattr(sys, "_MEIPASS", os.path.dirname(os.path.abspath(__file__)))
@@ -163,6 +287,17 @@ if __name__ == "__main__":
     parser.add_argument(
         "-p", "--pid", type=str, default=None, help="perf-collect on selected PID(s)"
     )
+    parser.add_argument(
+        "--process",
+        type=str,
+        default=None,
+        help="perf-collect on the processes with the selected name(s), as shown by ps -o comm",
+    )
+    parser.add_argument(
+        "--perpid",
+        help="collect each PID in a separate output, <outcsv>.<pid>.csv, for per process metrics",
+        action="store_true",
+    )
     parser.add_argument(
         "-c",
         "--cgroup",
@@ -171,11 +306,29 @@ if __name__ == "__main__":
         help="perf-collect on selected cgroup(s)",
     )
     parser.add_argument(
-        "-t", "--timeout", type=int, default=None, help="perf event collection time"
+        "-t",
+        "--timeout",
+        "--duration",
+        type=int,
+        default=None,
+        help="perf event collection time in seconds",
     )
     parser.add_argument(
         "--percore", help="Enable per core event collection", action="store_true"
     )
+    parser.add_argument(
+        "--cpu",
+        type=str,
+        default=None,
+        help="limit system wide collection to a CPU list such as 0-3,8 or NUMA node(s) such as node0",
+    )
+    parser.add_argument(
+        "--perflimit",
+        type=str,
+        action="append",
+        default=None,
+        help="set a kernel perf limit during collection as NAME=VALUE, can be repeated. Requires root privileges",
+    )
     parser.add_argument(
         "--nogroups",
         help="Disable perf event grouping, events are grouped by default as in the event file",
@@ -186,6 +339,11 @@ if __name__ == "__main__":
         help="Test if Performance Monitoring Counters are in-use, and collect stats for 10sec to validate event file correctness",
         action="store_true",
     )
+    parser.add_argument(
+        "--preflight",
+        help="check if the system is ready for perf collection and exit",
+        action="store_true",
+    )
     parser.add_argument(
         "--metadata",
         help="collect system info only, does not run perf",
@@ -205,6 +363,25 @@ if __name__ == "__main__":
         default="VM",
         help="Instance type: Options include - VM,BM",
     )
+    parser.add_argument(
+        "--encrypt",
+        type=str,
+        action="append",
+        default=None,
+        help="encrypt the output to an age (age1...) or PGP recipient, can be repeated",
+    )
+    parser.add_argument(
+        "--sign",
+        type=str,
+        default=None,
+        help="write a sha256 manifest of the output signed with the given gpg key",
+    )
+    parser.add_argument(
+        "--redact",
+        choices=["standard", "strict"],
+        default=None,
+        help="redact identifying kernel boot parameters from the metadata, standard hashes their values and strict also drops parameters that don't affect results",
+    )
 
     args = parser.parse_args()
 
@@ -212,11 +389,39 @@ if __name__ == "__main__":
         print(perf_helpers.get_tool_version())
         sys.exit(0)
 
+    perf_limits = perf_helpers.parse_perf_limits(args.perflimit or [])
+
+    if args.preflight:
+        outcsv = args.outcsv
+        if outcsv == default_output_file and not os.path.exists(result_dir):
+            outcsv = result_dir
+        sys.exit(0 if preflight_check(outcsv) else 1)
+
     interval = int(args.interval * 1000)
 
     if args.app and args.timeout:
         raise SystemExit("Please provide time duration or application parameter")
 
+    pids = args.pid.split(",") if args.pid else []
+    if args.process:
+        for name in args.process.split(","):
+            process_pids = perf_helpers.get_process_pids(name.strip())
+            if not process_pids:
+                raise SystemExit("No running process named %s" % name.strip())
+            pids += process_pids
+    if pids:
+        # drop duplicate pids, each pid is collected once
+        pids = [pid.strip() for pid in pids if pid.strip()]
+        args.pid = ",".join(sorted(set(pids), key=pids.index))
+
+    if args.perpid and not args.pid:
+        raise SystemExit("Please provide PIDs to collect separately with --perpid")
+
+    if args.encrypt:
+        perf_helpers.get_encryption_tool(args.encrypt)
+    if args.sign:
+        perf_helpers.check_tool("gpg", "sign outputs")
+
     if args.muxinterval > 1000:
         raise SystemExit(
             "Input argument muxinterval is too large, max is [1s or 1000ms]"
@@ -225,10 +430,30 @@ if __name__ == "__main__":
         raise SystemExit(
             "Input argument dump interval is too large or too small, range is [0.1 to 300s]!"
         )
+    if args.timeout is not None and args.timeout < args.interval:
+        raise SystemExit(
+            "Input argument duration should be at least one dump interval long"
+        )
 
     # select architecture default event file if not supplied
     procinfo = perf_helpers.get_cpuinfo()
     arch, cpuname = perf_helpers.check_architecture(procinfo)
+
+    if args.cpu is not None:
+        if args.pid or args.cgroup or args.percore:
+            raise SystemExit("--cpu can't be used with --pid, --cgroup or --percore")
+        try:
+            cpus = perf_helpers.parse_cpu_list(args.cpu)
+        except ValueError:
+            raise SystemExit(
+                "Invalid CPU list %s, expected a list such as 0-3,8 or node0"
+                % args.cpu
+            )
+        online = [int(proc["processor"]) for proc in procinfo if "processor" in proc]
+        offline = [str(c) for c in cpus if c not in online]
+        if offline:
+            raise SystemExit("CPU(s) %s not online" % ",".join(offline))
+        args.cpu = ",".join(str(c) for c in cpus)
     eventfile = args.eventfile
     eventfilename = eventfile
 
@@ -277,6 +502,17 @@ if __name__ == "__main__":
     if not os.path.isfile(eventfile):
         raise SystemExit("event file not found")
 
+    virtualization = perf_helpers.get_virtualization(procinfo)
+    pmu_exposure = perf_helpers.get_pmu_exposure(procinfo)
+    if virtualization != "none":
+        print("Info: running in a %s virtual machine" % virtualization)
+        if args.cloudtype in ("BM", "bm"):
+            print("Warning: cloudtype is BM but a hypervisor was detected")
+        if pmu_exposure == "none":
+            print("Warning: PMU isn't exposed to the VM, enable vPMU in the hypervisor")
+        elif pmu_exposure == "core only":
+            print("Info: uncore PMUs aren't exposed to the VM, only core events enabled")
+
     if args.outcsv == default_output_file:
         # create results dir
         if not os.path.exists(result_dir):
@@ -293,209 +529,302 @@ if __name__ == "__main__":
         supervisor = True
 
     mux_intervals = perf_helpers.get_perf_event_mux_interval()
-    if args.muxinterval > 0:
-        if supervisor:
-            perf_helpers.set_perf_event_mux_interval(
-                False, args.muxinterval, mux_intervals
-            )
-        else:
-            print(
-                "Warning: perf event mux interval can't be set without sudo permission"
-            )
-
-    # disable nmi watchdog before collecting perf
+    # nmi watchdog is disabled while collecting perf
     f_nmi = open("/proc/sys/kernel/nmi_watchdog", "r")
     nmi_watchdog = f_nmi.read()
     f_nmi.close()
+    prev_perf_limits = {}
 
-    if int(nmi_watchdog) != 0:
-        if supervisor:
-            f_nmi = open("/proc/sys/kernel/nmi_watchdog", "w")
-            f_nmi.write("0")
-            f_nmi.close()
-        else:
-            print("Warning: nmi_watchdog enabled, perf grouping will be disabled")
-            args.nogroups = True
-
-    # disable grouping if more than 1 cgroups are being monitored
-    if args.cgroup is not None:
-        num_cgroups = prep_events.get_num_cgroups(args.cgroup)
-        if num_cgroups > 1:
-            args.nogroups = True
+    # SIGTERM from timeout, a job scheduler or kill would skip the restore below,
+    # exit through it instead
+    signal.signal(signal.SIGTERM, lambda signum, frame: sys.exit(128 + signum))
 
+    # restore the system settings changed below when collection ends or fails
     try:
-        import re
-
-        reg = r"^[0-9]*\.[0-9][0-9]*"
-        kernel = perf_helpers.get_version().split("Linux version")[1].lstrip()
-        significant_kernel_version = float(re.match(reg, kernel).group(0))
-        full_kernel_version = kernel
-
-    except Exception as e:
-        print(e)
-        raise SystemExit("Unable to get kernel version")
-
-    # Fix events not compatible with older kernel versions only
-    if significant_kernel_version == 3.10 and arch != "broadwell":
-        kernel_version = full_kernel_version.split(" ")[0]
-        prep_events.fix_events_for_older_kernels(eventfile, kernel_version)
-
-    # get perf events to collect
-    collection_events = []
-    events, collection_events = prep_events.prepare_perf_events(
-        eventfile, (args.nogroups is False), ((args.pid or args.cgroup) is not None)
-    )
+        if args.muxinterval > 0:
+            if supervisor:
+                perf_helpers.set_perf_event_mux_interval(
+                    False, args.muxinterval, mux_intervals
+                )
+            else:
+                print(
+                    "Warning: perf event mux interval can't be set without sudo permission"
+                )
 
-    if args.metadata:
-        cpuid_info = perf_helpers.get_cpuid_info(procinfo)
-        write_metadata(
-            args.outcsv,
-            collection_events,
-            arch,
-            cpuname,
-            cpuid_info,
-            args.interval,
-            args.muxinterval,
-            args.nogroups,
-            args.percore,
-            supervisor,
-            True,
-        )
-        sys.exit("Output with metadata in  %s" % args.outcsv)
-
-    collection_type = "-a" if args.percore is False else "-a -A"
-    # start perf stat
-    if args.pid and args.timeout:
-        print("Info: Only CPU/core events will be enabled with pid option")
-        cmd = "perf stat -I %d -x , --pid %s -e %s -o %s sleep %d" % (
-            interval,
-            args.pid,
-            events,
-            args.outcsv,
-            args.timeout,
+        if int(nmi_watchdog) != 0:
+            if supervisor:
+                f_nmi = open("/proc/sys/kernel/nmi_watchdog", "w")
+                f_nmi.write("0")
+                f_nmi.close()
+            else:
+                print("Warning: nmi_watchdog enabled, perf grouping will be disabled")
+                args.nogroups = True
+
+        if perf_limits:
+            if supervisor:
+                prev_perf_limits = perf_helpers.set_perf_limits(perf_limits)
+            else:
+                print("Warning: perf limits can't be set without sudo permission")
+
+        # disable grouping if more than 1 cgroups are being monitored
+        if args.cgroup is not None:
+            num_cgroups = prep_events.get_num_cgroups(args.cgroup)
+            if num_cgroups > 1:
+                args.nogroups = True
+
+        try:
+            import re
+
+            reg = r"^[0-9]*\.[0-9][0-9]*"
+            kernel = perf_helpers.get_version().split("Linux version")[1].lstrip()
+            significant_kernel_version = float(re.match(reg, kernel).group(0))
+            full_kernel_version = kernel
+
+        except Exception as e:
+            print(e)
+            raise SystemExit("Unable to get kernel version")
+
+        # Fix events not compatible with older kernel versions only
+        if significant_kernel_version == 3.10 and arch != "broadwell":
+            kernel_version = full_kernel_version.split(" ")[0]
+            prep_events.fix_events_for_older_kernels(eventfile, kernel_version)
+
+        collection_env = get_collection_env(args.pid)
+        collection_env += list(perf_helpers.get_perf_limits().items())
+        collection_env.append(("virtualization", virtualization))
+        collection_env.append(("exposed PMUs", pmu_exposure))
+        cmdline = perf_helpers.get_kernel_cmdline()
+        redacted = cmdline
+        if args.redact:
+            redacted = perf_helpers.redact_kernel_cmdline(cmdline, args.redact)
+        collection_env.append(("kernel cmdline", redacted.replace(",", ";")))
+        if args.cpu:
+            collection_env.append(("cpu list", args.cpu.replace(",", ";")))
+        for param, reason in perf_helpers.get_perf_boot_params(cmdline):
+            print(
+                "Info: kernel boot parameter %s may affect results, %s"
+                % (param, reason)
+            )
+        for conflict in perf_helpers.get_boot_param_conflicts(cmdline):
+            print("Warning: %s" % conflict)
+
+        # get perf events to collect
+        collection_events = []
+        # uncore events count the whole socket, they can't be limited to a CPU list
+        cpu_only = (args.pid or args.cgroup or args.cpu) is not None
+        cpu_only = cpu_only or pmu_exposure == "core only"
+        events, collection_events = prep_events.prepare_perf_events(
+            eventfile, (args.nogroups is False), cpu_only
         )
 
-    elif args.pid:
-        print("Info: Only CPU/core events will be enabled with pid option")
-        cmd = "perf stat -I %d -x , --pid %s -e %s -o %s" % (
-            interval,
-            args.pid,
-            events,
-            args.outcsv,
-        )
+        if args.metadata:
+            cpuid_info = perf_helpers.get_cpuid_info(procinfo)
+            write_metadata(
+                args.outcsv,
+                collection_events,
+                arch,
+                cpuname,
+                cpuid_info,
+                args.interval,
+                args.muxinterval,
+                args.nogroups,
+                args.percore,
+                supervisor,
+                collection_env,
+                [],
+                True,
+            )
+            outputs = [args.outcsv]
+            if args.encrypt:
+                outputs = [perf_helpers.encrypt_file(f, args.encrypt) for f in outputs]
+            if args.sign:
+                signature = perf_helpers.sign_files(outputs, args.sign)
+                print("signed manifest %s" % signature)
+            sys.exit("Output with metadata in  %s" % ", ".join(outputs))
+
+        collection_type = "-a" if args.percore is False else "-a -A"
+        if args.cpu:
+            collection_type += " -C " + args.cpu
+            print("Info: Only CPU/core events will be enabled with cpu option")
+        # start perf stat
+        perf_cmds = []
+        if args.pid:
+            print("Info: Only CPU/core events will be enabled with pid option")
+            pids = args.pid.split(",") if args.perpid else [args.pid]
+            for pid in pids:
+                outcsv = args.outcsv
+                if args.perpid:
+                    outcsv = get_pid_outfile(args.outcsv, pid)
+                cmd = "perf stat -I %d -x , --pid %s -e %s -o %s" % (
+                    interval,
+                    pid,
+                    events,
+                    outcsv,
+                )
+                if args.timeout:
+                    cmd += " sleep %d" % args.timeout
+                perf_cmds.append((cmd, outcsv))
+
+        elif args.cgroup and args.timeout:
+            print("Info: Only CPU/core events will be enabled with cgroup option")
+            if num_cgroups == 1:
+                cmd = "perf stat -I %d -x , -e %s -G %s -a -o %s sleep %d" % (
+                    interval,
+                    events,
+                    args.cgroup,
+                    args.outcsv,
+                    args.timeout,
+                )
+            else:
+                perf_format = prep_events.get_cgroup_events_format(args.cgroup, events)
+                cmd = "perf stat -I %d -x , %s -o %s sleep %d" % (
+                    interval,
+                    perf_format,
+                    args.outcsv,
+                    args.timeout,
+                )
 
-    elif args.cgroup and args.timeout:
-        print("Info: Only CPU/core events will be enabled with cgroup option")
-        if num_cgroups == 1:
-            cmd = "perf stat -I %d -x , -e %s -G %s -a -o %s sleep %d" % (
+        elif args.cgroup:
+            print("Info: Only CPU/core events will be enabled with cgroup option")
+            if num_cgroups == 1:
+                cmd = "perf stat -I %d -x , -e %s -G %s -o %s" % (
+                    interval,
+                    events,
+                    args.cgroup,
+                    args.outcsv,
+                )
+            else:
+                perf_format = prep_events.get_cgroup_events_format(args.cgroup, events)
+                cmd = "perf stat -I %d -x , %s -o %s" % (
+                    interval,
+                    perf_format,
+                    args.outcsv,
+                )
+        elif args.app:
+            cmd = "perf stat %s -I %d -x , -e %s -o %s %s" % (
+                collection_type,
                 interval,
                 events,
-                args.cgroup,
                 args.outcsv,
-                args.timeout,
+                args.app,
             )
-        else:
-            perf_format = prep_events.get_cgroup_events_format(args.cgroup, events)
-            cmd = "perf stat -I %d -x , %s -o %s sleep %d" % (
+        elif args.timeout:
+            cmd = "perf stat %s -I %d -x , -e %s -o %s sleep %d" % (
+                collection_type,
                 interval,
-                perf_format,
+                events,
                 args.outcsv,
                 args.timeout,
             )
-
-    elif args.cgroup:
-        print("Info: Only CPU/core events will be enabled with cgroup option")
-        if num_cgroups == 1:
-            cmd = "perf stat -I %d -x , -e %s -G %s -o %s" % (
+        elif args.dryrun:
+            if virtualization != "none":
+                # PMU MSRs are emulated or not accessible in virtual machines
+                print("Info: skipping PMU usage check in a virtual machine")
+            else:
+                with open("results/pmu-checker.log", "w") as fw:
+                    print("Checking if PMU counters are in-use already...")
+                    pmuargs = resource_path("pmu-checker")
+                    try:
+                        run_result = run(  # nosec
+                            shlex.split(pmuargs),
+                            stdout=PIPE,
+                            stderr=PIPE,
+                            universal_newlines=True,
+                        )
+                        fw.write(str(run_result.stdout))
+
+                    except Exception as e:
+                        print(e)
+
+            cmd = "perf stat %s -I %d -x , -e %s -o %s sleep 10" % (
+                collection_type,
                 interval,
                 events,
-                args.cgroup,
                 args.outcsv,
             )
         else:
-            perf_format = prep_events.get_cgroup_events_format(args.cgroup, events)
-            cmd = "perf stat -I %d -x , %s -o %s" % (interval, perf_format, args.outcsv)
-    elif args.app:
-        cmd = "perf stat %s -I %d -x , -e %s -o %s %s" % (
-            collection_type,
-            interval,
-            events,
-            args.outcsv,
-            args.app,
+            cmd = "perf stat %s -I %d -x , -e %s -o %s" % (
+                collection_type,
+                interval,
+                events,
+                args.outcsv,
+            )
+        if not perf_cmds:
+            perf_cmds.append((cmd, args.outcsv))
+        perfargs_list = []
+        for cmd, _ in perf_cmds:
+            perfargs = shlex.split(cmd)
+            validate_perfargs(perfargs)
+            perfargs_list.append(perfargs)
+        # SIGUSR1 adds a marker with the elapsed collection time
+        markers = []
+        start_time = time.time()
+        signal.signal(
+            signal.SIGUSR1,
+            lambda signum, frame: markers.append(time.time() - start_time),
         )
-    elif args.timeout:
-        cmd = "perf stat %s -I %d -x , -e %s -o %s sleep %d" % (
-            collection_type,
-            interval,
-            events,
-            args.outcsv,
-            args.timeout,
+        print(
+            "Info: run 'kill -USR1 %d' to add a marker during collection" % os.getpid()
         )
-    elif args.dryrun:
-        with open("results/pmu-checker.log", "w") as fw:
-            print("Checking if PMU counters are in-use already...")
-            pmuargs = resource_path("pmu-checker")
-            try:
-                run_result = run(  # nosec
-                    shlex.split(pmuargs),
-                    stdout=PIPE,
-                    stderr=PIPE,
-                    universal_newlines=True,
+        perf_procs = []
+        try:
+            print("Collecting perf stat for events in : %s" % eventfilename)
+            if args.cloud != "none":
+                print(
+                    "Consider using cloudtype flag to set instance type -> VM/BM; Default is VM"
                 )
-                fw.write(str(run_result.stdout))
+            # perf prints decimal commas in some locales which breaks the csv output
+            perf_env = perf_helpers.get_c_locale_env()
+            for perfargs in perfargs_list:
+                perf_procs.append(subprocess.Popen(perfargs, env=perf_env))  # nosec
+            for proc in perf_procs:
+                proc.wait()
+            print("Collection complete! Calculating TSC frequency now")
+        except KeyboardInterrupt:
+            # perf got the interrupt as well, wait for it to flush the output
+            for proc in perf_procs:
+                proc.wait()
+            print("Collection stopped! Caculating TSC frequency now")
+        except SystemExit:
+            # terminated, stop perf before the settings are restored
+            for proc in perf_procs:
+                proc.terminate()
+            raise
+        except Exception:
+            print("perf encountered errors")
 
-            except Exception as e:
-                print(e)
-
-        cmd = "perf stat %s -I %d -x , -e %s -o %s sleep 10" % (
-            collection_type,
-            interval,
-            events,
-            args.outcsv,
-        )
-    else:
-        cmd = "perf stat %s -I %d -x , -e %s -o %s" % (
-            collection_type,
-            interval,
-            events,
-            args.outcsv,
-        )
-    perfargs = shlex.split(cmd)
-    validate_perfargs(perfargs)
-    try:
-        print("Collecting perf stat for events in : %s" % eventfilename)
-        if args.cloud != "none":
-            print(
-                "Consider using cloudtype flag to set instance type -> VM/BM; Default is VM"
+        cpuid_info = perf_helpers.get_cpuid_info(procinfo)
+        outputs = [outcsv for _, outcsv in perf_cmds]
+        for outcsv in outputs:
+            write_metadata(
+                outcsv,
+                collection_events,
+                arch,
+                cpuname,
+                cpuid_info,
+                args.interval,
+                args.muxinterval,
+                args.nogroups,
+                args.percore,
+                supervisor,
+                collection_env,
+                markers,
+                False,
             )
-        subprocess.call(perfargs)  # nosec
-        print("Collection complete! Calculating TSC frequency now")
-    except KeyboardInterrupt:
-        print("Collection stopped! Caculating TSC frequency now")
-    except Exception:
-        print("perf encountered errors")
-
-    cpuid_info = perf_helpers.get_cpuid_info(procinfo)
-    write_metadata(
-        args.outcsv,
-        collection_events,
-        arch,
-        cpuname,
-        cpuid_info,
-        args.interval,
-        args.muxinterval,
-        args.nogroups,
-        args.percore,
-        supervisor,
-        False,
-    )
-
-    if (int(nmi_watchdog) != 0) and supervisor:
-        f_nmi = open("/proc/sys/kernel/nmi_watchdog", "w")
-        f_nmi.write(nmi_watchdog)
-
-    if (args.muxinterval > 0) and supervisor:
-        perf_helpers.set_perf_event_mux_interval(True, 1, mux_intervals)
-
-    print("perf stat dumped to %s" % args.outcsv)
+    finally:
+        if (int(nmi_watchdog) != 0) and supervisor:
+            with open("/proc/sys/kernel/nmi_watchdog", "w") as f_nmi:
+                f_nmi.write(nmi_watchdog)
+
+        if (args.muxinterval > 0) and supervisor:
+            perf_helpers.set_perf_event_mux_interval(True, 1, mux_intervals)
+
+        if prev_perf_limits:
+            perf_helpers.set_perf_limits(prev_perf_limits)
+
+    if args.encrypt:
+        outputs = [perf_helpers.encrypt_file(f, args.encrypt) for f in outputs]
+    if args.sign:
+        print("signed manifest %s" % perf_helpers.sign_files(outputs, args.sign))
+    print("perf stat dumped to %s" % ", ".join(outputs))
     perf_helpers.fix_path_ownership(result_dir, True)
@@ -11,6 +11,8 @@ import re
 import sys
 import csv
 import json
+import fnmatch
+import shutil
 import collections
 from src import perf_helpers
 from simpleeval import simple_eval
@@ -30,6 +32,9 @@ tmp_socket_file = script_path + "/_tmp_perf_/tmp_socket_out.csv"
 # temporary output:trasposed view of perf-collect output
 time_dump_file = script_path + "/_tmp_perf_/time_dump.csv"
 
+# temporary output: perf-collect outputs merged into one timeline
+merged_raw_file = script_path + "/_tmp_perf_/merged_perfstat.csv"
+
 # final output of post-process
 out_metric_file = script_path + "/results/metric_out.csv"
 
@@ -135,6 +140,8 @@ PERCORE_MODE = False
 TIME_ZONE = "UTC"
 PERF_EVENTS = []
 SOCKET_CORES = []
+MARKERS = []
+GAPS = []
 
 
 # get the PMU names from metric expression
@@ -354,6 +361,12 @@ def get_extra_out_file(out_file, t, excelsheet=False):
         text = "core.raw"
     elif t == "m":
         text = "sys"
+    elif t == "mk":
+        text = "markers"
+    elif t == "en":
+        text = "energy"
+    elif t == "fq":
+        text = "frequency"
     if excelsheet:
         return text
     parts = os.path.splitext(filename)
@@ -585,6 +598,65 @@ def write_summary(level=0):
                 out_idx += 1
 
 
+# add user defined metrics derived from the system level metrics
+# [name] references a metric column, [pattern*] sums all matching columns
+def add_derived_metrics(derived_file):
+    validate_file(derived_file)
+    with open(derived_file, "r") as f_derived:
+        try:
+            derived = json.load(f_derived)
+        except json.decoder.JSONDecodeError:
+            raise SystemExit(
+                "Invalid JSON, please provide a valid JSON as derived metrics file"
+            )
+    with open(out_metric_file, "r") as f_metrics:
+        rows = [row for row in csv.reader(f_metrics, delimiter=",") if row]
+    header = rows[0]
+    for metric in derived:
+        if not isinstance(metric, dict) or not {"name", "expression"} <= set(metric):
+            raise SystemExit(
+                "Invalid derived metric %s, name and expression are required" % metric
+            )
+        refs = get_metric_events(metric["expression"])
+        columns = []
+        for ref in refs:
+            matches = fnmatch.filter(header[1:], ref)
+            if not matches:
+                print("Warning: %s not found, skipping %s" % (ref, metric["name"]))
+                break
+            columns.append([header.index(m) for m in matches])
+        if len(columns) != len(refs):
+            continue
+        for row in rows[1:]:
+            formula = metric["expression"]
+            for ref, idxs in zip(refs, columns):
+                value = sum(float(row[i]) for i in idxs)
+                formula = formula.replace("[" + ref + "]", str(value))
+            try:
+                result = simple_eval(formula, functions={"min": min, "max": max})
+                row.append("{:.8f}".format(result))
+            except ZeroDivisionError:
+                row.append("0")
+            except SyntaxError:
+                raise SystemExit(
+                    "Syntax error evaluating derived metric %s: %s"
+                    % (metric["name"], metric["expression"])
+                )
+            except Exception as e:
+                raise SystemExit(
+                    "Unknown error evaluating derived metric %s: %s"
+                    % (metric["name"], e)
+                )
+        header.append(metric["name"])
+
+    with open(out_metric_file, "w") as f_metrics:
+        metriccsv = csv.writer(f_metrics, dialect="excel")
+        for i, row in enumerate(rows):
+            metriccsv.writerow(row)
+            if EXCEL_OUT:
+                OUT_WORKBOOK.writerow(i, row, "m")
+
+
 def get_online_corecount():
     return int(CONST_CORE_COUNT * CONST_HT_COUNT * CONST_SOCKET_COUNT)
 
@@ -608,10 +680,12 @@ def get_metadata():
     global PERCORE_MODE
     global SOCKET_CORES
     global TIME_ZONE
+    global MARKERS
+    global GAPS
 
     start_events = False
     validate_file(dat_file)
-    f_dat = open(dat_file, "r")
+    f_dat = open(dat_file, "r", encoding="utf-8")
     for line in f_dat:
         if start_events:
             if "PERF DATA" in line:
@@ -644,11 +718,83 @@ def get_metadata():
         elif line.startswith("Socket"):
             cores = ((line.split("\n")[0]).split(",")[1]).split(";")[:-1]
             SOCKET_CORES.append(cores)
+        elif line.startswith("Marker"):
+            MARKERS.append(float(line.split(",")[1]))
+        elif line.startswith("Gap"):
+            GAPS.append((float(line.split(",")[1]), float(line.split(",")[2])))
         elif "### PERF EVENTS" in line:
             start_events = True
     f_dat.close()
 
 
+# merge perf-collect outputs from the same host into one timeline ordered by start time
+# each following capture starts with a gap row that resets the sample interval to
+# the capture start, the gaps are recorded in the metadata as start and end seconds
+def merge_raw_files(raw_files):
+    keys = ("Architecture", "Sampling", "Event grouping", "Percore mode")
+    captures = []
+    for raw_file in raw_files:
+        validate_file(raw_file)
+        with open(raw_file, "r", encoding="utf-8") as f_raw:
+            lines = f_raw.readlines()
+        starts = [i for i, line in enumerate(lines) if "PERF DATA" in line]
+        if not starts or len(lines) <= starts[0] + 1:
+            raise SystemExit("%s is not a perf-collect output" % raw_file)
+        start = starts[0]
+        try:
+            epoch = int(lines[start + 1].split()[-1])
+        except ValueError:
+            raise SystemExit("Conversion error parsing timestamp in %s" % raw_file)
+        config = []
+        markers = []
+        in_events = False
+        for line in lines[:start]:
+            in_events = in_events or "PERF EVENTS" in line
+            if in_events or line.startswith(keys):
+                config.append(line)
+            elif line.startswith("Marker"):
+                markers.append(float(line.split(",")[1]))
+        header = [line for line in lines[: start + 2] if not line.startswith("Marker")]
+        captures.append((epoch, config, markers, header, lines[start + 2 :]))
+    captures.sort(key=lambda c: c[0])
+
+    first_epoch, first_config, _, header, _ = captures[0]
+    merged_data = []
+    merged_markers = []
+    gaps = []
+    last_sample = 0.0
+    for i, (epoch, config, markers, _, data) in enumerate(captures):
+        if config != first_config:
+            raise SystemExit("perf-collect outputs have different settings")
+        offset = epoch - first_epoch
+        merged_markers += [marker + offset for marker in markers]
+        if i:
+            # start times have a second resolution, back to back captures may overlap
+            gaps.append((last_sample, max(offset, last_sample)))
+            merged_data.append("Gap,%.9f\n" % offset)
+        for line in data:
+            try:
+                sample_time, rest = line.split(",", 1)
+                sample_time = float(sample_time)
+            except ValueError:
+                if not i:
+                    merged_data.append(line)
+                continue
+            last_sample = sample_time + offset
+            merged_data.append("%.9f,%s" % (last_sample, rest))
+
+    start = [i for i, line in enumerate(header) if "PERF EVENTS" in line][0]
+    with open(merged_raw_file, "w", encoding="utf-8") as f_merged:
+        f_merged.writelines(header[:start])
+        for marker in merged_markers:
+            f_merged.write("Marker,%.3f,\n" % marker)
+        for gap_start, gap_end in gaps:
+            f_merged.write("Gap,%.3f,%.3f,\n" % (gap_start, gap_end))
+        f_merged.writelines(header[start:])
+        f_merged.writelines(merged_data)
+    return merged_raw_file
+
+
 # write perf output from perf stat dump
 def write_perf_tmp_output(use_epoch):
     global CONST_TSC_FREQ
@@ -675,7 +821,7 @@ def write_perf_tmp_output(use_epoch):
     samples = 0
     epoch = 0
     validate_file(dat_file)
-    with open(dat_file, "r") as f_dat:
+    with open(dat_file, "r", encoding="utf-8") as f_dat:
         incsv = csv.reader(f_dat, delimiter=",")
         row0_event_name.append("time")
 
@@ -693,7 +839,14 @@ def write_perf_tmp_output(use_epoch):
                     exit("Conversion error parsing timestamp")
                 except:
                     exit("Unkown error parsing timestamp")
+            if row and row[0] == "Gap":
+                # merged captures, the next sample interval starts at the capture start
+                prev_sample_time_row = float(row[1])
+                continue
             if row and start_perf and (len(row) > 3):
+                # perf prints the time with a decimal comma in some locales
+                if "." not in row[0]:
+                    exit("perf output uses a decimal comma, collect with LC_ALL=C")
                 time = float(row[0])
                 # extract data , Note: relies on the perf output format
                 if use_epoch:
@@ -1167,18 +1320,112 @@ def write_system_view():
     f_sum.close()
 
 
+# write markers added during collection with the matching sample
+def write_markers():
+    # rows of (elapsed seconds, marker, gap seconds), gaps are marked at their end
+    rows = [(marker, i + 1, "") for i, marker in enumerate(MARKERS)]
+    rows += [(end, "gap", end - start) for start, end in GAPS]
+    markers_file = get_extra_out_file(out_metric_file, "mk")
+    with open(markers_file, "w") as f_markers:
+        markerscsv = csv.writer(f_markers, dialect="excel")
+        markerscsv.writerow(["marker", "elapsed seconds", "sample", "gap seconds"])
+        for elapsed, marker, gap in sorted(rows, key=lambda r: r[0]):
+            # time spent in earlier gaps has no samples
+            gap_time = sum(end - start for start, end in GAPS if end <= elapsed)
+            sample = int((elapsed - gap_time) / CONST_INTERVAL) + 1
+            markerscsv.writerow([marker, elapsed, sample, gap])
+
+
+# power metrics of the metric files, derived metrics summing them are skipped
+power_metrics = ["metric_package power (watts)", "metric_DRAM power (watts)"]
+
+
+# check if a metric column is a power metric, per socket columns end with .S<n>
+def is_power_metric(name):
+    return re.sub(r"\.S\d+$", "", name) in power_metrics
+
+
+# write energy consumed over the collection window and its estimated cost,
+# per socket energy is only written when socket metrics are generated in this run
+def write_energy(price_per_kwh, persocket=False):
+    metric_files = [out_metric_file]
+    if persocket:
+        metric_files.append(get_extra_out_file(out_metric_file, "s"))
+    energy = collections.OrderedDict()
+    for metric_file in metric_files:
+        with open(metric_file, "r") as f_metrics:
+            for row in csv.DictReader(f_metrics, delimiter=","):
+                for name, value in row.items():
+                    if is_power_metric(name):
+                        joules = float(value) * CONST_INTERVAL
+                        energy[name] = energy.get(name, 0.0) + joules
+    if not energy:
+        print("Warning: power metrics not found, energy can't be computed")
+        return
+
+    energy_file = get_extra_out_file(out_metric_file, "en")
+    with open(energy_file, "w") as f_energy:
+        energycsv = csv.writer(f_energy, dialect="excel")
+        energycsv.writerow(["metrics", "kWh", "cost"])
+        for name, joules in energy.items():
+            kwh = joules / 3600000
+            name = name.replace("power (watts)", "energy")
+            energycsv.writerow([name, kwh, kwh * price_per_kwh])
+
+
+# operating frequency metric of the metric files
+frequency_metric = "metric_CPU operating frequency (in GHz)"
+
+
+# write the distribution of the operating frequency over the collection window,
+# the share of samples in each bin_ghz wide bin for the system and each socket
+def write_frequency_histogram(bin_ghz, persocket=False):
+    metric_files = [out_metric_file]
+    if persocket:
+        metric_files.append(get_extra_out_file(out_metric_file, "s"))
+    bins = collections.OrderedDict()
+    for metric_file in metric_files:
+        with open(metric_file, "r") as f_metrics:
+            for row in csv.DictReader(f_metrics, delimiter=","):
+                for name, value in row.items():
+                    if not value or re.sub(r"\.S\d+$", "", name) != frequency_metric:
+                        continue
+                    label = "system"
+                    if name != frequency_metric:
+                        label = name.rsplit(".", 1)[1]
+                    # round before flooring so 0.3 / 0.1 lands in bin 3
+                    b = int(round(float(value) / bin_ghz, 6))
+                    bins.setdefault(label, []).append(b)
+    if not bins:
+        print("Warning: frequency metric not found, histogram can't be computed")
+        return
+
+    first = min(min(b) for b in bins.values())
+    last = max(max(b) for b in bins.values())
+    histogram_file = get_extra_out_file(out_metric_file, "fq")
+    with open(histogram_file, "w") as f_histogram:
+        histogramcsv = csv.writer(f_histogram, dialect="excel")
+        histogramcsv.writerow(["frequency (GHz)"] + [label + " %" for label in bins])
+        for b in range(first, last + 1):
+            row = ["%.2f-%.2f" % (b * bin_ghz, (b + 1) * bin_ghz)]
+            for samples in bins.values():
+                row.append("%.2f" % (100.0 * samples.count(b) / len(samples)))
+            histogramcsv.writerow(row)
+
+
 # delete given file
 def deletefile(tempfile):
     if os.path.isfile(tempfile):
         os.remove(tempfile)
 
 
-# cleanup temp files
-def cleanup():
+# cleanup temp files, csv outputs are removed for excel output unless keep_csv is set
+def cleanup(keep_csv=False):
     deletefile(time_dump_file)
     deletefile(output_file)
     deletefile(tmp_socket_file)
-    if EXCEL_OUT:
+    deletefile(merged_raw_file)
+    if EXCEL_OUT and not keep_csv:
         tempfile = get_extra_out_file(out_metric_file, "r")
         deletefile(tempfile)
         tempfile = get_extra_out_file(out_metric_file, "a")
@@ -1201,6 +1448,19 @@ def cleanup():
     os.rmdir(tmpdir)
 
 
+# get all generated outputs, and the intermediate files when they are kept
+def get_outputs(keep_all=False):
+    out_files = [out_metric_file]
+    if EXCEL_OUT:
+        out_files.append(out_metric_file[:-4] + "csv")
+    for t in ["a", "r", "s", "sa", "sr", "c", "ca", "cr", "mk", "en", "fq"]:
+        out_files.append(get_extra_out_file(out_metric_file, t))
+    if keep_all:
+        tmpdir = script_path + "/_tmp_perf_"
+        out_files += [os.path.join(tmpdir, f) for f in sorted(os.listdir(tmpdir))]
+    return [f for f in out_files if os.path.isfile(f)]
+
+
 # restrict joining path to same directories
 def is_safe_path(base_dir, path, follow_symlinks=True):
     if follow_symlinks:
@@ -1225,6 +1485,13 @@ if __name__ == "__main__":
         default=None,
         help="formula file, default metric file for the architecture",
     )
+    parser.add_argument(
+        "-d",
+        "--derivedfile",
+        type=str,
+        default=None,
+        help="file with user defined metrics derived from the system level metrics",
+    )
     parser.add_argument(
         "-o",
         "--outfile",
@@ -1238,6 +1505,23 @@ if __name__ == "__main__":
     parser.add_argument(
         "--percore", help="generate per core metrics", action="store_true"
     )
+    parser.add_argument(
+        "--energycost",
+        type=float,
+        default=None,
+        help="price per kWh, writes energy consumed per socket and its estimated cost",
+    )
+    parser.add_argument(
+        "--freqbin",
+        type=float,
+        default=None,
+        help="bin width in GHz, writes the distribution of the CPU operating frequency",
+    )
+    parser.add_argument(
+        "--keepcsv",
+        help="keep the standalone csv outputs when generating excel output",
+        action="store_true",
+    )
     parser.add_argument(
         "--keepall",
         help="keep all intermediate csv files, use it for debug purpose only",
@@ -1248,13 +1532,26 @@ if __name__ == "__main__":
         help="time series in epoch format, default is sample count",
         action="store_true",
     )
+    parser.add_argument(
+        "--encrypt",
+        type=str,
+        action="append",
+        default=None,
+        help="encrypt outputs to an age (age1...) or PGP recipient, can be repeated",
+    )
+    parser.add_argument(
+        "--sign",
+        type=str,
+        default=None,
+        help="write a sha256 manifest of the outputs signed with the given gpg key",
+    )
     required_arg = parser.add_argument_group("required arguments")
     required_arg.add_argument(
         "-r",
         "--rawfile",
         type=str,
         default=None,
-        help="Raw CSV output from perf-collect",
+        help="Raw CSV output from perf-collect, comma separated list of outputs from the same host are merged into one timeline",
     )
 
     args = parser.parse_args()
@@ -1278,6 +1575,9 @@ if __name__ == "__main__":
         os.mkdir(temp_dir)
 
     dat_file = args.rawfile
+    raw_files = dat_file.split(",")
+    if len(raw_files) > 1:
+        dat_file = merge_raw_files(raw_files)
     # default output file
     if args.outfile == out_metric_file:
         res_dir = script_path + "/results"
@@ -1297,6 +1597,12 @@ if __name__ == "__main__":
         )
     if not perf_helpers.check_file_writeable(args.outfile):
         raise SystemExit("Output file %s not writeable " % args.outfile)
+    if args.freqbin is not None and args.freqbin <= 0:
+        raise SystemExit("Frequency bin width must be greater than 0 GHz")
+    if args.encrypt:
+        perf_helpers.get_encryption_tool(args.encrypt)
+    if args.sign:
+        perf_helpers.check_tool("gpg", "sign outputs")
     if (args.outfile).endswith("xlsx"):
         try:
             import xlsxwriter
@@ -1369,11 +1675,27 @@ if __name__ == "__main__":
         else:
             write_system_view()
     if load_metrics():
+        if args.derivedfile:
+            add_derived_metrics(args.derivedfile)
         write_summary()
+    if MARKERS or GAPS:
+        write_markers()
+    if args.energycost is not None:
+        write_energy(args.energycost, persocket_output)
+    if args.freqbin is not None:
+        write_frequency_histogram(args.freqbin, persocket_output)
+    if EXCEL_OUT and args.keepcsv:
+        # the system metrics csv is written to the excel file path until it is closed
+        shutil.copyfile(out_metric_file, out_metric_file[:-4] + "csv")
     if not args.keepall:
-        cleanup()
+        cleanup(args.keepcsv)
     if EXCEL_OUT:
         OUT_WORKBOOK.close()
-    print("Post processing done, result file:%s" % args.outfile)
+    outputs = get_outputs(args.keepall)
+    if args.encrypt:
+        outputs = [perf_helpers.encrypt_file(f, args.encrypt) for f in outputs]
+    if args.sign:
+        print("signed manifest %s" % perf_helpers.sign_files(outputs, args.sign))
+    print("Post processing done, result file:%s" % ", ".join(outputs))
     if "res_dir" in locals():
         perf_helpers.fix_path_ownership(res_dir, True)
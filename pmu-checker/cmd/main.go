@@ -35,9 +35,12 @@ var (
 	loglevel       = flag.Bool("debug", false, "set the loglevel to debug, default is info")
 	multiLogWriter = flag.Bool("no-stdout", false, "set the logwriter to write to logfile only, default is false")
 	cpu            = flag.Int("cpu", 0, "Read MSRs on respective CPU, default is 0")
+	allCPUs        = flag.Bool("all-cpus", false, "Read MSRs on all online CPUs instead of -cpu")
 	logfile        = flag.String("logfile", "pmu-checker.log", "set the logfile name, default is pmu-checker.log")
 	help           = flag.Bool("help", false, "Shows the usage of pmu-checker application")
+	schema         = flag.Bool("schema", false, "Shows the JSON schema of the result")
 	logFileRegexp  = regexp.MustCompile(`([a-zA-Z0-9\s_\\.\-():])+(.log|.txt)$`)
+	cpus           []int
 )
 
 func initialize() error {
@@ -75,7 +78,15 @@ func initialize() error {
 		log.SetLevel(log.DebugLevel)
 	}
 
-	err = msr.Initialize()
+	cpus = []int{*cpu}
+	if *allCPUs == true {
+		cpus, err = msr.OnlineCPUs()
+		if err != nil {
+			return errors.Wrap(err, "couldn't get the CPUs to check")
+		}
+	}
+
+	err = msr.Initialize(cpus)
 	if err != nil {
 		return errors.Wrap(err, "couldn't initialize msr module")
 	}
@@ -84,11 +95,6 @@ func initialize() error {
 }
 
 func main() {
-	if os.Geteuid() != 0 {
-		println("You need a root privileges to run.")
-		os.Exit(2)
-	}
-
 	flag.Parse()
 
 	if *help == true {
@@ -97,16 +103,28 @@ func main() {
 		os.Exit(0)
 	}
 
+	if *schema == true {
+		fmt.Println(msr.Schema)
+		os.Exit(0)
+	}
+
+	if os.Geteuid() != 0 {
+		println("You need a root privileges to run.")
+		os.Exit(2)
+	}
+
 	err := initialize()
 	if err != nil {
 		log.Error(errors.Wrap(err, "couldn't initialize PMU Checker"))
 		os.Exit(2)
 	}
 
-	err = msr.ValidateMSRModule(*cpu)
-	if err != nil {
-		log.Error(errors.Wrap(err, "couldn't validate MSR module"))
-		os.Exit(2)
+	for _, c := range cpus {
+		err = msr.ValidateMSRModule(c)
+		if err != nil {
+			log.Error(errors.Wrap(err, "couldn't validate MSR module"))
+			os.Exit(2)
+		}
 	}
 
 	log.Info("Starting the PMU Checker application...")
@@ -125,23 +143,18 @@ func main() {
 func runIterations() {
 	for i := 1; i <= iterations; i++ {
 		var wg sync.WaitGroup
-		if len(msr.UsedPMUs) == 7 {
+		if msr.Pending() == 0 {
 			// if all the PMUs are being used, break the loop
 			log.Infof("Aborting iteration check #%d", i)
 			break
 		}
 
 		log.Debugf("Iteration check #%d started\n", i)
-		msr.Values.Range(func(key, value interface{}) bool {
-			_, ok := value.(uint64)
-			if !ok {
-				return false
-			}
-
+		// one worker per CPU, each keeps a single msr file open
+		for c, regs := range msr.PendingRegs() {
 			wg.Add(1)
-			go msr.ReadMSR(key.(string), &wg, i, *cpu)
-			return true
-		})
+			go msr.ReadMSRs(c, regs, &wg, i)
+		}
 
 		wg.Wait()
 		log.Infof("Iteration check #%d completed\n", i)
@@ -0,0 +1,49 @@
+//###########################################################################################################
+//# Copyright (C) 2021 Intel Corporation
+//# SPDX-License-Identifier: BSD-3-Clause
+//###########################################################################################################
+
+package msr
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const onlinePath = "/sys/devices/system/cpu/online"
+
+func parseCPUList(list string) ([]int, error) {
+	// Parses a CPU list such as 0-3,8 as used by sysfs
+
+	var cpus []int
+	for _, cpuRange := range strings.Split(strings.TrimSpace(list), ",") {
+		bounds := strings.SplitN(cpuRange, "-", 2)
+		start, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("invalid CPU list %s", list))
+		}
+		end := start
+		if len(bounds) == 2 {
+			end, err = strconv.Atoi(bounds[1])
+			if err != nil {
+				return nil, errors.Wrap(err, fmt.Sprintf("invalid CPU list %s", list))
+			}
+		}
+		for cpu := start; cpu <= end; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+	return cpus, nil
+}
+
+func OnlineCPUs() ([]int, error) {
+	online, err := ioutil.ReadFile(onlinePath)
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't read online CPUs")
+	}
+	return parseCPUList(string(online))
+}
@@ -0,0 +1,21 @@
+//###########################################################################################################
+//# Copyright (C) 2021 Intel Corporation
+//# SPDX-License-Identifier: BSD-3-Clause
+//###########################################################################################################
+
+package msr
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCPUList(t *testing.T) {
+	cpus, err := parseCPUList("0-3,8\n")
+	require.NoError(t, err)
+	require.Equal(t, []int{0, 1, 2, 3, 8}, cpus)
+
+	_, err = parseCPUList("0-x")
+	require.Error(t, err)
+}
@@ -8,6 +8,7 @@ package msr
 import (
 	"encoding/binary"
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -24,7 +25,8 @@ const (
 
 var (
 	Values     = sync.Map{}
-	UsedPMUs   []string
+	UsedPMUs   []Counter
+	usedMutex  sync.Mutex
 	pmuPurpose = map[string]string{
 		"0x309": "instructions",
 		"0x30a": "cpu_cycles",
@@ -36,6 +38,12 @@ var (
 	}
 )
 
+// Counter is a PMU counter MSR on a CPU
+type Counter struct {
+	CPU int
+	Reg string
+}
+
 type retMSR struct {
 	fd int
 }
@@ -80,74 +88,117 @@ func closeMSRInterface(dpt retMSR) error {
 	return syscall.Close(dpt.fd)
 }
 
-func ReadMSR(reg string, wg *sync.WaitGroup, thread int, cpu int) {
-	// Read MSR value, update map as needed
+// ReadMSRs reads the given PMU MSRs on a CPU, the msr interface is opened once
+// for all of them so a check keeps a single file open per CPU
+func ReadMSRs(cpu int, regs []string, wg *sync.WaitGroup, thread int) {
+	// Read MSR values, update map as needed
 
 	defer wg.Done()
-	log.Debugf("Worker %d starting %s", thread, reg)
-	hexreg := strings.Replace(reg, "0x", "", -1)
-	hexreg = strings.Replace(hexreg, "0X", "", -1)
-	regInt64, err := strconv.ParseInt(hexreg, 16, 64)
-	if err != nil {
-		log.Panicf("The Hex to int64 type covertion failed\nError: ", err)
-	}
-
+	log.Debugf("Worker %d starting CPU %d", thread, cpu)
 	msr, err := openMSRInterface(cpu)
 	if err != nil {
 		log.Panic(err)
 	}
 
-	msrVal, err := msr.read(regInt64)
-	if err != nil {
-		log.Panic(err)
+	for _, reg := range regs {
+		hexreg := strings.Replace(reg, "0x", "", -1)
+		hexreg = strings.Replace(hexreg, "0X", "", -1)
+		regInt64, err := strconv.ParseInt(hexreg, 16, 64)
+		if err != nil {
+			log.Panicf("The Hex to int64 type covertion failed\nError: %v", err)
+		}
+
+		msrVal, err := msr.read(regInt64)
+		if err != nil {
+			log.Panic(err)
+		}
+
+		updateCounter(Counter{CPU: cpu, Reg: reg}, msrVal, thread)
 	}
 
 	err = closeMSRInterface(*msr)
 	if err != nil {
 		log.Panic(err)
 	}
+	log.Debugf("Worker %d done for CPU %d\n", thread, cpu)
+}
+
+func updateCounter(counter Counter, msrVal uint64, thread int) {
+	// Store the new value of a counter, a changed value means the PMU is in use
 
-	log.Debugf("New value of thread %d for %s is %d", thread, reg, msrVal)
-	currentVal, found := Values.Load(reg)
-	Values.Store(reg, msrVal)
+	log.Debugf("New value of thread %d for %s on CPU %d is %d", thread, counter.Reg, counter.CPU, msrVal)
+	currentVal, found := Values.Load(counter)
+	Values.Store(counter, msrVal)
 	if found == false {
 		// The key has been deleted, meaning PMU was active
 	}
 
-	log.Debugf("Old value of thread %d for %s is %d", thread, reg, currentVal)
+	log.Debugf("Old value of thread %d for %s is %d", thread, counter.Reg, currentVal)
 
 	if found == true && currentVal != uint64(0) && msrVal != currentVal {
 		// The key exists but value has changed, delete it
 
-		UsedPMUs = append(UsedPMUs, reg)
-		log.Debugf("Deleting %s in the thread %d", reg, thread)
-		Values.Delete(reg)
+		usedMutex.Lock()
+		UsedPMUs = append(UsedPMUs, counter)
+		usedMutex.Unlock()
+		log.Debugf("Deleting %s on CPU %d in the thread %d", counter.Reg, counter.CPU, thread)
+		Values.Delete(counter)
 
 	}
-	log.Debugf("Worker %d done for %s\n", thread, reg)
-
 }
 
-func Initialize() error {
-	for regPMU, _ := range pmuPurpose {
-		Values.Store(regPMU, uint64(0))
+func Initialize(cpus []int) error {
+	for _, cpu := range cpus {
+		for regPMU, _ := range pmuPurpose {
+			Values.Store(Counter{CPU: cpu, Reg: regPMU}, uint64(0))
+		}
 	}
 
 	return nil
 }
 
+// Pending returns the number of counters that haven't been seen in use yet
+func Pending() int {
+	pending := 0
+	Values.Range(func(key, value interface{}) bool {
+		pending++
+		return true
+	})
+	return pending
+}
+
+// PendingRegs returns the counters that haven't been seen in use yet by CPU
+func PendingRegs() map[int][]string {
+	pending := make(map[int][]string)
+	Values.Range(func(key, value interface{}) bool {
+		counter := key.(Counter)
+		pending[counter.CPU] = append(pending[counter.CPU], counter.Reg)
+		return true
+	})
+	for _, regs := range pending {
+		sort.Strings(regs)
+	}
+	return pending
+}
+
 func GetActivePMUs() (Result, error) {
 	var res Result
+	res.SchemaVersion = SchemaVersion
 	res.PMUDetails = make(map[string]string)
+	res.PMUCPUs = make(map[string][]int)
 	log.Info("Following PMU(s) are actively being used:")
 	for _, pmu := range UsedPMUs {
-		purpose, ok := pmuPurpose[pmu]
+		purpose, ok := pmuPurpose[pmu.Reg]
 		if !ok {
 			return Result{}, errors.New("Report this to the Developers.")
 		}
-		res.PMUDetails[pmu] = purpose
-		res.PMUActive++
-		log.Infof("%s: might be using: %s", pmu, purpose)
+		res.PMUDetails[pmu.Reg] = purpose
+		res.PMUCPUs[pmu.Reg] = append(res.PMUCPUs[pmu.Reg], pmu.CPU)
+		log.Infof("%s on CPU %d: might be using: %s", pmu.Reg, pmu.CPU, purpose)
+	}
+	res.PMUActive = len(res.PMUDetails)
+	for _, cpus := range res.PMUCPUs {
+		sort.Ints(cpus)
 	}
 
 	return res, nil
@@ -0,0 +1,48 @@
+//###########################################################################################################
+//# Copyright (C) 2021 Intel Corporation
+//# SPDX-License-Identifier: BSD-3-Clause
+//###########################################################################################################
+
+package msr
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetActivePMUs(t *testing.T) {
+	UsedPMUs = []Counter{{CPU: 3, Reg: "0xc1"}, {CPU: 0, Reg: "0x309"}, {CPU: 1, Reg: "0xc1"}}
+	defer func() { UsedPMUs = nil }()
+
+	res, err := GetActivePMUs()
+	require.NoError(t, err)
+	require.Equal(t, 2, res.PMUActive)
+	require.Equal(t, map[string]string{"0xc1": generalPurposePMU, "0x309": "instructions"}, res.PMUDetails)
+	require.Equal(t, map[string][]int{"0xc1": {1, 3}, "0x309": {0}}, res.PMUCPUs)
+}
+
+func TestUpdateCounter(t *testing.T) {
+	defer func() {
+		Values = sync.Map{}
+		UsedPMUs = nil
+	}()
+	err := Initialize([]int{0, 2})
+	require.NoError(t, err)
+	require.Equal(t, 14, Pending())
+
+	counter := Counter{CPU: 2, Reg: "0xc1"}
+	// the first read only records the value
+	updateCounter(counter, 100, 1)
+	updateCounter(Counter{CPU: 0, Reg: "0xc1"}, 100, 1)
+	require.Empty(t, UsedPMUs)
+	// a changed value marks the counter as used on its CPU
+	updateCounter(counter, 200, 2)
+	updateCounter(Counter{CPU: 0, Reg: "0xc1"}, 100, 2)
+	require.Equal(t, []Counter{counter}, UsedPMUs)
+
+	pending := PendingRegs()
+	require.Len(t, pending[0], 7)
+	require.Equal(t, []string{"0x309", "0x30a", "0x30b", "0xc2", "0xc3", "0xc4"}, pending[2])
+}
@@ -12,9 +12,53 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// SchemaVersion is the version of the Result JSON format, bump it on incompatible changes
+const SchemaVersion = "1.0"
+
+// Schema is the JSON schema of Result
+const Schema = `{
+	"$schema": "http://json-schema.org/draft-07/schema#",
+	"title": "pmu-checker result",
+	"type": "object",
+	"required": ["schema_version", "active_pmus", "details", "cpus"],
+	"properties": {
+		"schema_version": {
+			"description": "version of the result format",
+			"type": "string",
+			"const": "1.0"
+		},
+		"active_pmus": {
+			"description": "number of PMUs actively being used",
+			"type": "integer",
+			"minimum": 0
+		},
+		"details": {
+			"description": "MSR of each active PMU mapped to what might be using it",
+			"type": "object",
+			"additionalProperties": {
+				"type": "string"
+			}
+		},
+		"cpus": {
+			"description": "MSR of each active PMU mapped to the CPUs it is being used on",
+			"type": "object",
+			"additionalProperties": {
+				"type": "array",
+				"items": {
+					"type": "integer",
+					"minimum": 0
+				}
+			}
+		}
+	},
+	"additionalProperties": false
+}`
+
 type Result struct {
-	PMUActive  int               `json:"active_pmus"`
-	PMUDetails map[string]string `json:"details"`
+	SchemaVersion string            `json:"schema_version"`
+	PMUActive     int               `json:"active_pmus"`
+	PMUDetails    map[string]string `json:"details"`
+	PMUCPUs       map[string][]int  `json:"cpus"`
 }
 
 func (r Result) String() string {
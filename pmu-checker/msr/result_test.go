@@ -0,0 +1,42 @@
+//###########################################################################################################
+//# Copyright (C) 2021 Intel Corporation
+//# SPDX-License-Identifier: BSD-3-Clause
+//###########################################################################################################
+
+package msr
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSchemaVersion(t *testing.T) {
+	var schema struct {
+		Required   []string `json:"required"`
+		Properties struct {
+			SchemaVersion struct {
+				Const string `json:"const"`
+			} `json:"schema_version"`
+		} `json:"properties"`
+	}
+	err := json.Unmarshal([]byte(Schema), &schema)
+	require.NoError(t, err)
+	require.Equal(t, SchemaVersion, schema.Properties.SchemaVersion.Const)
+
+	res := Result{
+		SchemaVersion: SchemaVersion,
+		PMUActive:     1,
+		PMUDetails:    map[string]string{"0x309": "instructions"},
+		PMUCPUs:       map[string][]int{"0x309": {0}},
+	}
+	var out map[string]interface{}
+	err = json.Unmarshal([]byte(res.String()), &out)
+	require.NoError(t, err)
+	require.Equal(t, SchemaVersion, out["schema_version"])
+	for _, key := range schema.Required {
+		require.NotNil(t, out[key], key)
+	}
+	require.Len(t, out, len(schema.Required))
+}
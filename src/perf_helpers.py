@@ -10,6 +10,9 @@ import fnmatch
 import time
 import struct
 import math
+import shutil
+import hashlib
+import hmac
 import collections
 import subprocess  # nosec
 from time import strptime
@@ -52,6 +55,144 @@ def get_cpu_count():
     return cpu_count / (get_socket_count() * get_ht_count())
 
 
+# parse a cpu list such as 0-3,8 or node0 into a sorted list of cpu ids,
+# raises ValueError on empty lists and descending ranges
+def parse_cpu_list(cpu_list):
+    cpus = set()
+    for cpu_range in cpu_list.split(","):
+        cpu_range = cpu_range.strip()
+        if cpu_range.startswith("node"):
+            node = int(cpu_range[len("node") :])
+            node_cpus = read_first_line(
+                "/sys/devices/system/node/node%d/cpulist" % node
+            )
+            if not node_cpus:
+                raise ValueError("NUMA node %d not found" % node)
+            cpus.update(parse_cpu_list(node_cpus))
+            continue
+        start, sep, end = cpu_range.partition("-")
+        start = int(start)
+        end = int(end) if sep else start
+        if end < start:
+            raise ValueError("descending CPU range %s" % cpu_range)
+        cpus.update(range(start, end + 1))
+    if not cpus:
+        raise ValueError("empty CPU list")
+    return sorted(cpus)
+
+
+# read the first line of a file, returns None if the file can't be read
+def read_first_line(path):
+    if not path:
+        return None
+    try:
+        with open(path, "r") as f:
+            return f.readline().strip()
+    except EnvironmentError:
+        return None
+
+
+# cgroup and proc mount points, tests point them to a fake tree
+cgroup_mount = "/sys/fs/cgroup"
+proc_mount = "/proc"
+
+
+# get cgroup version of the host, 2 for unified hierarchy
+def get_cgroup_version():
+    if os.path.isfile(os.path.join(cgroup_mount, "cgroup.controllers")):
+        return 2
+    return 1
+
+
+# get cgroup paths of a process as {controller: path}, unified hierarchy uses ""
+def get_proc_cgroups(pid="self"):
+    cgroups = {}
+    try:
+        with open(os.path.join(proc_mount, str(pid), "cgroup"), "r") as f:
+            for line in f:
+                parts = line.strip().split(":", 2)
+                if len(parts) != 3:
+                    continue
+                for controller in parts[1].split(","):
+                    cgroups[controller] = parts[2]
+    except EnvironmentError:
+        pass
+    return cgroups
+
+
+# get the directories of a cgroup from the leaf up to the mount point, limits set
+# on a parent apply to its children. Containers mount their own cgroup at the
+# root, levels missing from the mount are skipped
+def get_cgroup_dirs(mount, path):
+    parts = [p for p in path.split("/") if p]
+    dirs = [os.path.join(mount, *parts[:i]) for i in range(len(parts), -1, -1)]
+    return [d for d in dirs if os.path.isdir(d)]
+
+
+# get effective cgroup cpu quota, cpuset and memory limit of a process,
+# the lowest quota and memory limit of the cgroup and its ancestors
+def get_cgroup_limits(pid="self"):
+    limits = collections.OrderedDict()
+    limits["cpu quota"] = "unlimited"
+    limits["cpuset"] = "all"
+    limits["memory limit"] = "unlimited"
+    cgroups = get_proc_cgroups(pid)
+    quotas = []
+    mem_limits = []
+    cpuset = None
+    if get_cgroup_version() == 2:
+        dirs = get_cgroup_dirs(cgroup_mount, cgroups.get("", "/"))
+        for d in dirs:
+            cpu_max = read_first_line(os.path.join(d, "cpu.max"))
+            if cpu_max and not cpu_max.startswith("max"):
+                quota, period = cpu_max.split()
+                quotas.append(float(quota) / float(period))
+            mem_limits.append(read_first_line(os.path.join(d, "memory.max")))
+        if dirs:
+            cpuset = read_first_line(os.path.join(dirs[0], "cpuset.cpus.effective"))
+    else:
+        mount = os.path.join(cgroup_mount, "cpu,cpuacct")
+        if not os.path.isdir(mount):
+            mount = os.path.join(cgroup_mount, "cpu")
+        for d in get_cgroup_dirs(mount, cgroups.get("cpu", "/")):
+            quota = read_first_line(os.path.join(d, "cpu.cfs_quota_us"))
+            period = read_first_line(os.path.join(d, "cpu.cfs_period_us"))
+            if quota and period and int(quota) > 0:
+                quotas.append(float(quota) / float(period))
+        cpuset_mount = os.path.join(cgroup_mount, "cpuset")
+        dirs = get_cgroup_dirs(cpuset_mount, cgroups.get("cpuset", "/"))
+        if dirs:
+            cpuset = read_first_line(os.path.join(dirs[0], "cpuset.cpus"))
+        mem_mount = os.path.join(cgroup_mount, "memory")
+        for d in get_cgroup_dirs(mem_mount, cgroups.get("memory", "/")):
+            mem_limit = read_first_line(os.path.join(d, "memory.limit_in_bytes"))
+            mem_limits.append(mem_limit)
+    if quotas:
+        limits["cpu quota"] = "%.2f" % min(quotas)
+    if cpuset:
+        limits["cpuset"] = cpuset
+    # cgroup v1 reports "no limit" as a page aligned LONG_MAX
+    mem_limits = [int(m) for m in mem_limits if m and m.isdigit() and int(m) < 2**62]
+    if mem_limits:
+        limits["memory limit"] = str(min(mem_limits))
+    return limits
+
+
+# get the number of CPUs a process is allowed to run on
+def get_cpu_affinity_count(pid=0):
+    try:
+        return len(os.sched_getaffinity(int(pid)))
+    except (AttributeError, OSError, ValueError):
+        return os.cpu_count()
+
+
+# environment for running tools with non localized, parseable output
+def get_c_locale_env():
+    env = dict(os.environ)
+    env["LC_ALL"] = "C"
+    return env
+
+
 # compute tsc frequency
 def get_tsc_freq():
     script_path = os.path.dirname(os.path.realpath(__file__))
@@ -149,6 +290,74 @@ def set_perf_event_mux_interval(reset, interval_ms, mux_interval):
                         f_mux.write(str(val))
 
 
+# kernel perf driver limits that affect perf collection and their valid range
+perf_limits = collections.OrderedDict(
+    [
+        ("perf_event_paranoid", (-1, 4)),
+        ("perf_event_max_sample_rate", (1, 2**31 - 1)),
+        ("perf_cpu_time_max_percent", (0, 100)),
+        ("perf_event_mlock_kb", (0, 2**31 - 1)),
+        ("perf_event_max_stack", (0, 640 * 1024)),
+    ]
+)
+
+
+# get the sysctl file of a kernel perf driver limit
+def get_perf_limit_path(name):
+    return os.path.join(proc_mount, "sys", "kernel", name)
+
+
+# parse perf limits given as name=value, raises SystemExit on unknown limits and
+# values out of range
+def parse_perf_limits(limits):
+    parsed = collections.OrderedDict()
+    for limit in limits:
+        name, _, value = limit.partition("=")
+        if name not in perf_limits or not value.lstrip("-").isdigit():
+            raise SystemExit(
+                "Invalid perf limit %s, supported limits are %s"
+                % (limit, ", ".join(perf_limits))
+            )
+        low, high = perf_limits[name]
+        if not low <= int(value) <= high:
+            raise SystemExit(
+                "Invalid perf limit %s, %s range is %d to %d" % (limit, name, low, high)
+            )
+        parsed[name] = int(value)
+    return parsed
+
+
+# get kernel perf driver limits
+def get_perf_limits():
+    limits = collections.OrderedDict()
+    for name in perf_limits:
+        value = read_first_line(get_perf_limit_path(name))
+        if value is not None:
+            limits[name] = value
+    return limits
+
+
+# set kernel perf driver limits, returns the previous values for reset
+# the limits already set are restored if one of them can't be set
+def set_perf_limits(limits):
+    previous = get_perf_limits()
+    written = []
+    for name, value in limits.items():
+        try:
+            with open(get_perf_limit_path(name), "w") as f_limit:
+                f_limit.write(str(value))
+        except OSError as e:
+            for done in written:
+                try:
+                    with open(get_perf_limit_path(done), "w") as f_limit:
+                        f_limit.write(previous[done])
+                except OSError:
+                    print("Warning: failed to restore %s" % done)
+            raise SystemExit("failed to set %s to %s, %s" % (name, value, e.strerror))
+        written.append(name)
+    return {name: previous[name] for name in written if name in previous}
+
+
 # extend uncore events to all cores
 def enumerate_uncore(event, n):
     event_list = []
@@ -235,6 +444,132 @@ def get_version():
     return version
 
 
+# kernel boot parameters known to affect performance measurements
+perf_boot_params = {
+    "isolcpus": "isolated CPUs are excluded from scheduling",
+    "nohz_full": "adaptive tick CPUs change timer interrupt behavior",
+    "idle": "idle states are overridden",
+    "intel_idle.max_cstate": "C-states are limited",
+    "processor.max_cstate": "C-states are limited",
+    "intel_pstate": "P-state driver behavior is changed",
+    "mitigations": "CPU vulnerability mitigations are changed",
+    "nosmt": "SMT is disabled",
+    "maxcpus": "number of CPUs is limited",
+    "mem": "memory size is limited",
+    "nmi_watchdog": "NMI watchdog setting is changed",
+    "iommu": "IOMMU mode changes DMA translation overhead",
+    "intel_iommu": "IOMMU mode changes DMA translation overhead",
+    "hugepages": "memory is reserved for huge pages",
+    "default_hugepagesz": "default huge page size is changed",
+    "transparent_hugepage": "transparent huge pages behavior is changed",
+}
+
+
+# get linux kernel boot parameters
+def get_kernel_cmdline():
+    return read_first_line("/proc/cmdline") or ""
+
+
+# get the kernel boot parameters that affect performance measurements
+def get_perf_boot_params(cmdline):
+    params = []
+    for param in cmdline.split():
+        name = param.split("=")[0]
+        if name in perf_boot_params:
+            params.append((param, perf_boot_params[name]))
+    return params
+
+
+# kernel boot parameters with values that may identify the system
+identifying_boot_params = [
+    "BOOT_IMAGE",
+    "root",
+    "resume",
+    "ip",
+    "nfsroot",
+    "hostname",
+    "cryptdevice",
+    "rd.luks.uuid",
+    "rd.lvm.lv",
+]
+
+
+# redact kernel boot parameters, "standard" hashes identifying values and
+# "strict" also drops parameters that don't affect performance measurements.
+# Values are hashed with a random key that isn't stored, so they can't be
+# recovered by hashing candidate hostnames or addresses
+def redact_kernel_cmdline(cmdline, level):
+    key = os.urandom(32)
+    params = []
+    for param in cmdline.split():
+        name, sep, value = param.partition("=")
+        if level == "strict" and name not in perf_boot_params:
+            continue
+        if name in identifying_boot_params and value:
+            value = hmac.new(key, value.encode(), hashlib.sha256).hexdigest()[:12]
+        params.append(name + sep + value)
+    return " ".join(params)
+
+
+# get the pids of the processes with the given name as in /proc/<pid>/comm
+def get_process_pids(name):
+    pids = [pid for pid in os.listdir("/proc") if pid.isdigit()]
+    pids = [pid for pid in pids if read_first_line("/proc/%s/comm" % pid) == name]
+    return sorted(pids, key=int)
+
+
+# check if a process with the given name is running
+def is_process_running(name):
+    return len(get_process_pids(name)) > 0
+
+
+# get conflicts between kernel boot parameters and the running system
+def get_boot_param_conflicts(cmdline):
+    conflicts = []
+    names = [param.split("=")[0] for param in cmdline.split()]
+    if "isolcpus" in names and is_process_running("irqbalance"):
+        conflicts.append(
+            "isolcpus is set but irqbalance is running, interrupts may be balanced to isolated CPUs"
+        )
+    return conflicts
+
+
+# hypervisors as reported by dmi sys_vendor or product_name
+hypervisors = [
+    ("VMware", "vmware"),
+    ("KVM", "kvm"),
+    ("QEMU", "kvm"),
+    ("Microsoft", "hyperv"),
+    ("Xen", "xen"),
+]
+
+
+# get the hypervisor when running in a virtual machine, "none" on bare metal
+def get_virtualization(procinfo):
+    if "hypervisor" not in procinfo[0].get("flags", "").split():
+        return "none"
+    dmi = " ".join(
+        read_first_line("/sys/class/dmi/id/" + f) or ""
+        for f in ("sys_vendor", "product_name")
+    )
+    for name, hypervisor in hypervisors:
+        if name in dmi:
+            return hypervisor
+    return "unknown"
+
+
+# get the PMU exposed to the system, uncore PMUs in a VM imply host-passthrough
+def get_pmu_exposure(procinfo):
+    if "arch_perfmon" not in procinfo[0].get("flags", "").split():
+        return "none"
+    devices = "/sys/bus/event_source/devices"
+    if os.path.isdir(devices) and any(
+        d.startswith("uncore_") for d in os.listdir(devices)
+    ):
+        return "core and uncore"
+    return "core only"
+
+
 # populate the CPU info list after reading /proc/cpuinfo in list of dictionaries
 def get_cpuinfo():
     cpuinfo = []
@@ -259,11 +594,13 @@ def get_cpuinfo():
 def get_lscpu():
     cpuinfo = {}
     try:
-        lscpu = subprocess.check_output(["lscpu"], universal_newlines=True)  # nosec
+        lscpu = subprocess.check_output(  # nosec
+            ["lscpu"], universal_newlines=True, env=get_c_locale_env()
+        )
         # print(lscpu.split("\n"))
         lscpu = [i for i in lscpu.split("\n") if i]
         for prop in lscpu:
-            key, value = prop.split(":")
+            key, value = prop.split(":", 1)
             value = value.lstrip()
             cpuinfo[key] = value
     except subprocess.CalledProcessError as e:
@@ -271,13 +608,35 @@ def get_lscpu():
     return cpuinfo
 
 
-def not_suported():
+def not_suported(detected=None):
+    if detected:
+        print("Detected %s" % detected)
     print(
         "Current architecture not supported!\nThis version only suports Broadwell/Skylake/Cascadelake/Icelake. Exiting!"
     )
     sys.exit()
 
 
+# Arm CPU implementer and part numbers as reported in /proc/cpuinfo
+arm_cpus = {
+    ("0x41", "0xd0c"): "Arm Neoverse-N1 (e.g. Ampere Altra, Altra Max)",
+    ("0x41", "0xd40"): "Arm Neoverse-V1",
+    ("0x41", "0xd49"): "Arm Neoverse-N2 (e.g. Alibaba Yitian 710)",
+    ("0x41", "0xd4f"): "Arm Neoverse-V2",
+    ("0xc0", "0xac3"): "AmpereOne",
+    ("0xc0", "0xac4"): "AmpereOne",
+}
+
+
+# get the name of an Arm CPU from its implementer and part, None if not Arm
+def get_arm_cpu(procinfo):
+    for cpu in procinfo:
+        if "CPU implementer" in cpu and "CPU part" in cpu:
+            key = (cpu["CPU implementer"].lower(), cpu["CPU part"].lower())
+            return arm_cpus.get(key, "Arm CPU implementer %s part %s" % key)
+    return None
+
+
 # Check if arch is broadwell/skyalke/cascadelake
 def check_architecture(procinfo):
     try:
@@ -289,6 +648,9 @@ def check_architecture(procinfo):
 
     except KeyError:
         # for non-Intel architectures
+        arm_cpu = get_arm_cpu(procinfo)
+        if arm_cpu:
+            not_suported(arm_cpu)
         cpuinfo = get_lscpu()
         modelname = str(cpuinfo["Model name"])
         stepping = str(cpuinfo["Stepping"])
@@ -383,10 +745,17 @@ def percentile(N, percent):
 def get_epoch(start_time):
     words = "".join(start_time).split()
     print(start_time)
-    month = words[4]
-    date = words[5]
-    year = words[7]
-    month = str(strptime(month, "%b").tm_mon)
+    # perf runs in the C locale, a localized date can't be parsed
+    try:
+        month = words[4]
+        date = words[5]
+        year = words[7]
+        month = str(strptime(month, "%b").tm_mon)
+    except (IndexError, ValueError):
+        raise SystemExit(
+            "Unable to parse perf start time %s, collect with LC_ALL=C"
+            % start_time.strip()
+        )
     # os.environ['TZ']='UTC'
     utc = tz.tzutc()
     utc_info = str(datetime.utcnow().replace(tzinfo=utc).astimezone(tz.tzlocal()))
@@ -400,6 +769,70 @@ def get_epoch(start_time):
     return epoch
 
 
+# get the tool used to encrypt outputs, age recipients start with "age1"
+def get_encryption_tool(recipients):
+    age = [r.startswith("age1") for r in recipients]
+    if any(age) and not all(age):
+        raise SystemExit("age and PGP recipients can't be mixed")
+    tool = "age" if all(age) else "gpg"
+    check_tool(tool, "encrypt outputs")
+    return tool
+
+
+# check if a tool needed for an optional feature is installed
+def check_tool(tool, purpose):
+    if shutil.which(tool) is None:
+        raise SystemExit(
+            "%s not found; please install %s to %s" % (tool, tool, purpose)
+        )
+
+
+# encrypt a file to the given recipients and remove the plaintext file
+def encrypt_file(path, recipients):
+    tool = get_encryption_tool(recipients)
+    encrypted = path + "." + tool
+    if tool == "age":
+        cmd = ["age", "-o", encrypted]
+    else:
+        cmd = ["gpg", "--batch", "--yes", "-o", encrypted, "--encrypt"]
+    for r in recipients:
+        cmd += ["-r", r]
+    cmd.append(path)
+    try:
+        subprocess.check_call(cmd)  # nosec
+    except subprocess.CalledProcessError:
+        raise SystemExit(
+            "failed to encrypt %s, check that the recipient keys are valid and trusted"
+            % path
+        )
+    os.remove(path)
+    return encrypted
+
+
+# write a sha256 manifest of the files and sign it with a detached gpg signature,
+# paths are relative to the manifest so sha256sum -c can run from its directory
+def sign_files(files, key):
+    check_tool("gpg", "sign outputs")
+    manifest = files[0] + ".sha256"
+    manifest_dir = os.path.dirname(os.path.abspath(manifest))
+    with open(manifest, "w") as f_manifest:
+        for path in files:
+            sha = hashlib.sha256()
+            with open(path, "rb") as f:
+                for chunk in iter(lambda: f.read(65536), b""):
+                    sha.update(chunk)
+            relpath = os.path.relpath(os.path.abspath(path), manifest_dir)
+            f_manifest.write("%s  %s\n" % (sha.hexdigest(), relpath))
+    signature = manifest + ".asc"
+    cmd = ["gpg", "--batch", "--yes", "--armor", "--detach-sign", "-u", key]
+    cmd += ["-o", signature, manifest]
+    try:
+        subprocess.check_call(cmd)  # nosec
+    except subprocess.CalledProcessError:
+        raise SystemExit("failed to sign %s" % manifest)
+    return signature
+
+
 def fix_path_ownership(path, recursive=False):
     """change the ownership of the results folder when executed with sudo previleges"""
     if not recursive:
@@ -198,7 +198,7 @@ def prepare_perf_events(event_file, grouping, cpu_only):
         # get supported perf events
         try:
             perf_list = subprocess.check_output(  # nosec
-                ["perf", "list"], universal_newlines=True
+                ["perf", "list"], universal_newlines=True, env=helper.get_c_locale_env()
             )
         except FileNotFoundError:
             raise SystemExit("perf not found; please install linux perf utility")
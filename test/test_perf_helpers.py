@@ -0,0 +1,305 @@
+###########################################################################################################
+# Copyright (C) 2021 Intel Corporation
+# SPDX-License-Identifier: BSD-3-Clause
+###########################################################################################################
+
+import os
+import sys
+import time
+import calendar
+import collections
+import subprocess  # nosec
+
+sys.path.insert(0, os.path.dirname(os.path.dirname(os.path.realpath(__file__))))
+from src import perf_helpers  # noqa: E402
+
+
+lscpu_output = """Architecture:                    x86_64
+CPU op-mode(s):                  32-bit, 64-bit
+Model name:                      Intel(R) Xeon(R) Gold 6348 CPU @ 2.60GHz
+Stepping:                        6
+Vulnerability Spectre v2:        Mitigation; Enhanced IBRS, IBPB: conditional, RSB filling
+"""
+
+
+def test_get_lscpu_value_with_colon(monkeypatch):
+    envs = []
+
+    def check_output(cmd, universal_newlines, env):
+        envs.append(env)
+        return lscpu_output
+
+    monkeypatch.setattr(perf_helpers.subprocess, "check_output", check_output)
+    cpuinfo = perf_helpers.get_lscpu()
+    assert envs[0]["LC_ALL"] == "C"
+    assert cpuinfo["Model name"] == "Intel(R) Xeon(R) Gold 6348 CPU @ 2.60GHz"
+    assert (
+        cpuinfo["Vulnerability Spectre v2"]
+        == "Mitigation; Enhanced IBRS, IBPB: conditional, RSB filling"
+    )
+
+
+def test_parse_cpu_list():
+    assert perf_helpers.parse_cpu_list("8, 0-3,2") == [0, 1, 2, 3, 8]
+    for cpu_list in ["", "3-1", "1,,2", "3-", "node-1"]:
+        try:
+            perf_helpers.parse_cpu_list(cpu_list)
+        except ValueError:
+            pass
+        else:
+            assert False, cpu_list
+
+
+def test_get_c_locale_env(monkeypatch):
+    monkeypatch.setenv("LANG", "de_DE.UTF-8")
+    monkeypatch.setenv("LC_ALL", "de_DE.UTF-8")
+    env = perf_helpers.get_c_locale_env()
+    assert env["LC_ALL"] == "C"
+    assert os.environ["LC_ALL"] == "de_DE.UTF-8"
+
+
+def test_get_epoch_c_locale(monkeypatch):
+    try:
+        with monkeypatch.context() as m:
+            m.setenv("TZ", "UTC")
+            time.tzset()
+            epoch = perf_helpers.get_epoch("# started on Mon Jan 15 10:00:00 2024\n")
+    finally:
+        # reload the restored TZ so UTC doesn't leak into later tests
+        time.tzset()
+    assert epoch == calendar.timegm((2024, 1, 15, 10, 0, 0))
+
+
+def test_get_epoch_localized():
+    # de_DE perf output, perf-collect runs perf in the C locale to avoid it
+    try:
+        perf_helpers.get_epoch("# started on Mo 15. Jan 10:00:00 2024\n")
+    except SystemExit as e:
+        assert "LC_ALL=C" in str(e)
+    else:
+        assert False
+
+
+def _write_cgroup_files(path, files):
+    os.makedirs(str(path), exist_ok=True)
+    for name, value in files.items():
+        with open(str(path / name), "w") as f:
+            f.write(value + "\n")
+
+
+def _fake_cgroups(monkeypatch, tmp_path, proc_cgroup):
+    monkeypatch.setattr(perf_helpers, "cgroup_mount", str(tmp_path / "cgroup"))
+    monkeypatch.setattr(perf_helpers, "proc_mount", str(tmp_path / "proc"))
+    _write_cgroup_files(tmp_path / "proc" / "self", {"cgroup": proc_cgroup})
+    return tmp_path / "cgroup"
+
+
+def test_get_proc_cgroups(monkeypatch, tmp_path):
+    _fake_cgroups(
+        monkeypatch, tmp_path, "4:cpu,cpuacct:/docker/abc\n2:memory:/docker/abc\n0::/"
+    )
+    cgroups = perf_helpers.get_proc_cgroups()
+    assert cgroups == {
+        "cpu": "/docker/abc",
+        "cpuacct": "/docker/abc",
+        "memory": "/docker/abc",
+        "": "/",
+    }
+
+
+def test_get_cgroup_dirs(tmp_path):
+    os.makedirs(str(tmp_path / "a" / "b"))
+    # the leaf is missing from the mount as in a container
+    dirs = perf_helpers.get_cgroup_dirs(str(tmp_path), "/a/b/c")
+    assert dirs == [str(tmp_path / "a" / "b"), str(tmp_path / "a"), str(tmp_path)]
+
+
+def test_get_cgroup_limits_v2(monkeypatch, tmp_path):
+    cgroup = _fake_cgroups(monkeypatch, tmp_path, "0::/slice/job")
+    _write_cgroup_files(cgroup, {"cgroup.controllers": "cpu cpuset memory"})
+    _write_cgroup_files(
+        cgroup / "slice", {"cpu.max": "200000 100000", "memory.max": "1073741824"}
+    )
+    _write_cgroup_files(
+        cgroup / "slice" / "job",
+        {
+            "cpu.max": "max 100000",
+            "memory.max": "2147483648",
+            "cpuset.cpus.effective": "0-3,8",
+        },
+    )
+    limits = perf_helpers.get_cgroup_limits()
+    assert limits["cpu quota"] == "2.00"
+    assert limits["cpuset"] == "0-3,8"
+    assert limits["memory limit"] == "1073741824"
+
+
+def test_get_cgroup_limits_v1(monkeypatch, tmp_path):
+    cgroup = _fake_cgroups(
+        monkeypatch,
+        tmp_path,
+        "4:cpu,cpuacct:/job\n3:cpuset:/job\n2:memory:/job",
+    )
+    _write_cgroup_files(
+        cgroup / "cpu,cpuacct",
+        {"cpu.cfs_quota_us": "400000", "cpu.cfs_period_us": "100000"},
+    )
+    _write_cgroup_files(
+        cgroup / "cpu,cpuacct" / "job",
+        {"cpu.cfs_quota_us": "150000", "cpu.cfs_period_us": "100000"},
+    )
+    _write_cgroup_files(cgroup / "cpuset" / "job", {"cpuset.cpus": "2-5"})
+    # page aligned LONG_MAX is reported when no memory limit is set
+    _write_cgroup_files(
+        cgroup / "memory", {"memory.limit_in_bytes": "9223372036854771712"}
+    )
+    _write_cgroup_files(
+        cgroup / "memory" / "job", {"memory.limit_in_bytes": "536870912"}
+    )
+    limits = perf_helpers.get_cgroup_limits()
+    assert limits["cpu quota"] == "1.50"
+    assert limits["cpuset"] == "2-5"
+    assert limits["memory limit"] == "536870912"
+
+
+def test_get_cgroup_limits_unlimited(monkeypatch, tmp_path):
+    cgroup = _fake_cgroups(monkeypatch, tmp_path, "2:memory:/\n1:cpu:/")
+    _write_cgroup_files(cgroup / "cpu", {"cpu.cfs_quota_us": "-1"})
+    _write_cgroup_files(
+        cgroup / "memory", {"memory.limit_in_bytes": "9223372036854771712"}
+    )
+    limits = perf_helpers.get_cgroup_limits()
+    assert list(limits.values()) == ["unlimited", "all", "unlimited"]
+
+
+cmdline = (
+    "BOOT_IMAGE=/vmlinuz-5.15 root=UUID=1234 ro quiet isolcpus=2-3 "
+    "resume=UUID=1234 hugepages=16"
+)
+
+
+def test_redact_kernel_cmdline_standard():
+    params = perf_helpers.redact_kernel_cmdline(cmdline, "standard").split()
+    names = [param.split("=")[0] for param in params]
+    assert names == [
+        "BOOT_IMAGE",
+        "root",
+        "ro",
+        "quiet",
+        "isolcpus",
+        "resume",
+        "hugepages",
+    ]
+    # identifying values are replaced by their hash
+    assert "vmlinuz" not in params[0]
+    assert "1234" not in params[1] + params[5]
+    assert params[2:5] == ["ro", "quiet", "isolcpus=2-3"]
+    assert params[6] == "hugepages=16"
+    # the same value hashes the same within one call
+    assert params[1].split("=", 1)[1] == params[5].split("=", 1)[1]
+
+
+def test_redact_kernel_cmdline_strict():
+    params = perf_helpers.redact_kernel_cmdline(cmdline, "strict")
+    assert params == "isolcpus=2-3 hugepages=16"
+
+
+def _fake_perf_limits(monkeypatch, tmp_path, limits):
+    monkeypatch.setattr(perf_helpers, "proc_mount", str(tmp_path))
+    kernel = tmp_path / "sys" / "kernel"
+    os.makedirs(str(kernel))
+    for name, value in limits.items():
+        with open(str(kernel / name), "w") as f:
+            f.write(value + "\n")
+    return kernel
+
+
+def test_parse_perf_limits():
+    limits = perf_helpers.parse_perf_limits(
+        ["perf_event_paranoid=-1", "perf_cpu_time_max_percent=100"]
+    )
+    assert list(limits.items()) == [
+        ("perf_event_paranoid", -1),
+        ("perf_cpu_time_max_percent", 100),
+    ]
+    for limit in [
+        "perf_event_paranoid=5",
+        "perf_cpu_time_max_percent=101",
+        "perf_event_max_sample_rate=0",
+        "perf_event_paranoid=",
+        "kptr_restrict=0",
+    ]:
+        try:
+            perf_helpers.parse_perf_limits([limit])
+        except SystemExit as e:
+            assert limit in str(e)
+        else:
+            assert False, limit
+
+
+def test_set_perf_limits(monkeypatch, tmp_path):
+    kernel = _fake_perf_limits(
+        monkeypatch,
+        tmp_path,
+        {"perf_event_paranoid": "2", "perf_event_mlock_kb": "516"},
+    )
+    previous = perf_helpers.set_perf_limits(
+        collections.OrderedDict([("perf_event_paranoid", -1)])
+    )
+    assert previous == {"perf_event_paranoid": "2"}
+    assert perf_helpers.get_perf_limits()["perf_event_paranoid"] == "-1"
+    perf_helpers.set_perf_limits(previous)
+    assert perf_helpers.read_first_line(str(kernel / "perf_event_paranoid")) == "2"
+
+
+def test_set_perf_limits_rollback(monkeypatch, tmp_path):
+    kernel = _fake_perf_limits(
+        monkeypatch,
+        tmp_path,
+        {"perf_event_paranoid": "2", "perf_event_mlock_kb": "516"},
+    )
+    # a directory in place of the sysctl file fails the second write
+    os.makedirs(str(kernel / "perf_event_max_stack"))
+    limits = collections.OrderedDict(
+        [
+            ("perf_event_paranoid", -1),
+            ("perf_event_mlock_kb", 2048),
+            ("perf_event_max_stack", 512),
+        ]
+    )
+    try:
+        perf_helpers.set_perf_limits(limits)
+    except SystemExit as e:
+        assert "perf_event_max_stack" in str(e)
+    else:
+        assert False
+    assert perf_helpers.get_perf_limits() == {
+        "perf_event_paranoid": "2",
+        "perf_event_mlock_kb": "516",
+    }
+
+
+def test_sign_files_manifest_paths(monkeypatch, tmp_path):
+    signed = []
+
+    def check_call(cmd):
+        signed.append(cmd[-1])
+
+    monkeypatch.setattr(perf_helpers, "check_tool", lambda tool, purpose: None)
+    monkeypatch.setattr(perf_helpers.subprocess, "check_call", check_call)
+    # --keepall intermediates are in another directory than the results
+    files = []
+    for name in ["results/metric_out.csv", "_tmp_perf_/time_dump.csv"]:
+        path = tmp_path / name
+        os.makedirs(str(path.parent), exist_ok=True)
+        path.write_text(name)
+        files.append(str(path))
+    signature = perf_helpers.sign_files(files, "key")
+    manifest = files[0] + ".sha256"
+    assert signed == [manifest] and signature == manifest + ".asc"
+    # check_call is stubbed for gpg, verify with run
+    verify = subprocess.run(
+        ["sha256sum", "-c", "--quiet", os.path.basename(manifest)],
+        cwd=os.path.dirname(manifest),
+    )
+    assert verify.returncode == 0
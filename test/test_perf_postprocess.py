@@ -0,0 +1,202 @@
+###########################################################################################################
+# Copyright (C) 2021 Intel Corporation
+# SPDX-License-Identifier: BSD-3-Clause
+###########################################################################################################
+
+import os
+import sys
+import csv
+import json
+import importlib.util
+
+root_dir = os.path.dirname(os.path.dirname(os.path.realpath(__file__)))
+sys.path.insert(0, root_dir)
+spec = importlib.util.spec_from_file_location(
+    "perf_postprocess", os.path.join(root_dir, "perf-postprocess.py")
+)
+postprocess = importlib.util.module_from_spec(spec)
+spec.loader.exec_module(postprocess)
+
+
+def _write_capture(path, epoch, samples, markers=()):
+    with open(path, "w") as f:
+        f.write("### META DATA ###,\n")
+        f.write("Sampling Interval,1,\n")
+        f.write("Architecture,icelake,\n")
+        f.write("Event grouping,enabled,\n")
+        f.write("Percore mode,disabled,\n")
+        for marker in markers:
+            f.write("Marker,%.3f,\n" % marker)
+        f.write("### PERF EVENTS ###,\n")
+        f.write("instructions\n")
+        f.write("\n")
+        f.write("### PERF DATA ###,\n")
+        f.write("# started on Mon Jan  1 00:00:00 2024 UTC EPOCH %d\n" % epoch)
+        for sample_time, value in samples:
+            f.write("%.9f,%d,,instructions,1000,100.00,,\n" % (sample_time, value))
+    return str(path)
+
+
+def _time_dump(tmp_path, raw_file):
+    postprocess.time_dump_file = str(tmp_path / "time_dump.csv")
+    postprocess.dat_file = raw_file
+    postprocess.write_perf_tmp_output(False)
+    with open(postprocess.time_dump_file, "r") as f:
+        return list(csv.reader(f))
+
+
+def _merge(tmp_path, captures):
+    postprocess.merged_raw_file = str(tmp_path / "merged.csv")
+    postprocess.dat_file = postprocess.merge_raw_files(captures)
+    postprocess.MARKERS = []
+    postprocess.GAPS = []
+    postprocess.PERF_EVENTS = []
+    postprocess.get_metadata()
+    return _time_dump(tmp_path, postprocess.dat_file)
+
+
+def test_write_perf_tmp_output_c_locale(tmp_path):
+    raw_file = _write_capture(tmp_path / "a.csv", 1000, [(0.5, 100), (1.0, 100)])
+    rows = _time_dump(tmp_path, raw_file)
+    assert [float(row[1]) for row in rows[1:]] == [200.0, 200.0]
+
+
+def test_write_perf_tmp_output_decimal_comma(tmp_path):
+    # de_DE perf output, the decimal comma splits the time into two fields
+    raw_file = _write_capture(tmp_path / "a.csv", 1000, [])
+    with open(raw_file, "a") as f:
+        f.write("1,000470436,100,,instructions,1000,100,00,,\n")
+    try:
+        _time_dump(tmp_path, raw_file)
+    except SystemExit as e:
+        assert "LC_ALL=C" in str(e)
+    else:
+        assert False
+
+
+def test_merge_raw_files_gap(tmp_path):
+    # two captures of 2 samples, the second starts 100s after the first one
+    first = _write_capture(tmp_path / "a.csv", 1000, [(1.0, 100), (2.0, 100)])
+    second = _write_capture(tmp_path / "b.csv", 1100, [(1.0, 100), (2.0, 100)])
+    rows = _merge(tmp_path, [second, first])
+    assert rows[0][:2] == ["time", "instructions"]
+    # samples after the gap are normalized to their own interval
+    assert [float(row[1]) for row in rows[1:]] == [100.0] * 4
+    assert postprocess.GAPS == [(2.0, 100.0)]
+
+
+def test_merge_raw_files_markers(tmp_path):
+    first = _write_capture(tmp_path / "a.csv", 1000, [(1.0, 100)], [0.5])
+    second = _write_capture(tmp_path / "b.csv", 1100, [(1.0, 100)], [0.25, 0.75])
+    _merge(tmp_path, [first, second])
+    # markers of later captures are offset by the capture start
+    assert postprocess.MARKERS == [0.5, 100.25, 100.75]
+
+
+def _derive(tmp_path, derived):
+    postprocess.out_metric_file = str(tmp_path / "metric_out.csv")
+    postprocess.EXCEL_OUT = False
+    with open(postprocess.out_metric_file, "w") as f:
+        f.write("time,metric_IPC,metric_package power (watts).S0,")
+        f.write("metric_package power (watts).S1\n")
+        f.write("1.0,2.0,100.0,50.0\n")
+        f.write("2.0,1.0,0.0,0.0\n")
+    derived_file = tmp_path / "derived.json"
+    derived_file.write_text(json.dumps(derived))
+    postprocess.add_derived_metrics(str(derived_file))
+    with open(postprocess.out_metric_file, "r") as f:
+        return [row for row in csv.reader(f) if row]
+
+
+def test_add_derived_metrics(tmp_path):
+    rows = _derive(
+        tmp_path,
+        [
+            {"name": "watts", "expression": "[metric_package power (watts)*]"},
+            {"name": "IPC_per_kwatt", "expression": "[metric_IPC] / [watts] * 1000"},
+            {"name": "missing", "expression": "[metric_CPI] * 2"},
+        ],
+    )
+    # missing references are skipped, chained references use earlier metrics
+    assert rows[0][4:] == ["watts", "IPC_per_kwatt"]
+    assert rows[1][4:] == ["150.00000000", "13.33333333"]
+    # division by zero yields 0
+    assert rows[2][4:] == ["0.00000000", "0"]
+
+
+def test_add_derived_metrics_invalid(tmp_path):
+    for metric in [
+        {"name": "bad", "expression": "[metric_IPC] +"},
+        {"expression": "[metric_IPC]"},
+        {"name": "bad"},
+    ]:
+        try:
+            _derive(tmp_path, [metric])
+        except SystemExit as e:
+            assert "derived metric" in str(e)
+        else:
+            assert False, metric
+
+
+def _energy(tmp_path, persocket):
+    postprocess.out_metric_file = str(tmp_path / "metric_out.csv")
+    postprocess.CONST_INTERVAL = 1.0
+    with open(postprocess.out_metric_file, "w") as f:
+        f.write("time,metric_package power (watts),metric_DRAM power (watts),")
+        f.write("tot_power (watts)\n")
+        for _ in range(3600):
+            f.write("1.0,200.0,50.0,250.0\n")
+    # socket metrics of an earlier run
+    socket_file = postprocess.get_extra_out_file(postprocess.out_metric_file, "s")
+    with open(socket_file, "w") as f:
+        f.write("time,metric_package power (watts).S0,")
+        f.write("metric_package power (watts).S1\n")
+        f.write("1.0,100.0,100.0\n")
+    postprocess.write_energy(0.5, persocket)
+    energy_file = postprocess.get_extra_out_file(postprocess.out_metric_file, "en")
+    with open(energy_file, "r") as f:
+        return [row for row in csv.reader(f) if row]
+
+
+def test_write_energy(tmp_path):
+    rows = _energy(tmp_path, False)
+    # derived metrics summing the power metrics aren't counted again
+    assert rows == [
+        ["metrics", "kWh", "cost"],
+        ["metric_package energy", "0.2", "0.1"],
+        ["metric_DRAM energy", "0.05", "0.025"],
+    ]
+
+
+def test_write_energy_persocket(tmp_path):
+    rows = _energy(tmp_path, True)
+    assert [row[0] for row in rows[3:]] == [
+        "metric_package energy.S0",
+        "metric_package energy.S1",
+    ]
+
+
+def test_write_frequency_histogram(tmp_path):
+    postprocess.out_metric_file = str(tmp_path / "metric_out.csv")
+    frequency = "metric_CPU operating frequency (in GHz)"
+    with open(postprocess.out_metric_file, "w") as f:
+        f.write("time,%s\n" % frequency)
+        for value in ["2.30", "2.35", "2.50", "2.10"]:
+            f.write("1.0,%s\n" % value)
+    socket_file = postprocess.get_extra_out_file(postprocess.out_metric_file, "s")
+    with open(socket_file, "w") as f:
+        f.write("time,%s.S0,%s.S1\n" % (frequency, frequency))
+        for _ in range(4):
+            f.write("1.0,2.30,2.10\n")
+    postprocess.write_frequency_histogram(0.1, True)
+    histogram_file = postprocess.get_extra_out_file(postprocess.out_metric_file, "fq")
+    with open(histogram_file, "r") as f:
+        rows = [row for row in csv.reader(f) if row]
+    assert rows == [
+        ["frequency (GHz)", "system %", "S0 %", "S1 %"],
+        ["2.10-2.20", "25.00", "0.00", "100.00"],
+        ["2.20-2.30", "0.00", "0.00", "0.00"],
+        ["2.30-2.40", "50.00", "100.00", "0.00"],
+        ["2.40-2.50", "0.00", "0.00", "0.00"],
+        ["2.50-2.60", "25.00", "0.00", "0.00"],
+    ]